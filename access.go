@@ -0,0 +1,125 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/Dadido3/configdb/tree"
+)
+
+// AccessPolicy defines what visitors are not allowed to do with the images of an element.
+// The zero value allows everything.
+type AccessPolicy struct {
+	NoZipDownload   bool // Albums can't be downloaded as archive
+	NoImageDownload bool // Single images can't be downloaded
+	NoOriginals     bool // Original image files can't be accessed at all, only reduced versions can be shown
+
+	Protections []*Protection // Passwords that are all needed to access the element
+	ShareOnly   bool          // The element can only be accessed via share links, see Share
+}
+
+// ParseAccessPolicy returns the access policy defined by the AllowZipDownload, AllowImageDownload, AllowOriginals, Password and ShareOnly keys of a source configuration.
+// Every missing key allows the corresponding access.
+// The url name and name of the source identify the protection, if there is a password.
+func ParseAccessPolicy(c tree.Node, urlName, name string) AccessPolicy {
+	p := AccessPolicy{}
+	if allow, ok := c["AllowZipDownload"].(bool); ok {
+		p.NoZipDownload = !allow
+	}
+	if allow, ok := c["AllowImageDownload"].(bool); ok {
+		p.NoImageDownload = !allow
+	}
+	if allow, ok := c["AllowOriginals"].(bool); ok {
+		p.NoOriginals = !allow
+	}
+	if password, ok := c["Password"].(string); ok && password != "" {
+		p.Protections = []*Protection{newProtection("source "+urlName, name, password)}
+	}
+	if shareOnly, ok := c["ShareOnly"].(bool); ok {
+		p.ShareOnly = shareOnly
+	}
+	return p
+}
+
+// Merge returns a policy that denies everything that one of both policies denies.
+func (p AccessPolicy) Merge(o AccessPolicy) AccessPolicy {
+	return AccessPolicy{
+		NoZipDownload:   p.NoZipDownload || o.NoZipDownload,
+		NoImageDownload: p.NoImageDownload || o.NoImageDownload,
+		NoOriginals:     p.NoOriginals || o.NoOriginals,
+		Protections:     mergeProtections(p.Protections, o.Protections),
+		ShareOnly:       p.ShareOnly || o.ShareOnly,
+	}
+}
+
+// mergeProtections returns a new list with all protections of both lists, without duplicates.
+func mergeProtections(a, b []*Protection) []*Protection {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+
+	result := make([]*Protection, 0, len(a)+len(b))
+	known := map[string]bool{}
+	for _, p := range append(append([]*Protection{}, a...), b...) {
+		if !known[p.key] {
+			known[p.key] = true
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// AllowsDownload returns whether images can be downloaded in the given size, see downloadSizes.
+// If archive is set, the images are downloaded as part of an archive.
+func (p AccessPolicy) AllowsDownload(size string, archive bool) bool {
+	if archive && p.NoZipDownload || !archive && p.NoImageDownload {
+		return false
+	}
+	if size == "original" && p.NoOriginals {
+		return false
+	}
+	return true
+}
+
+// ElementAccessPolicy is implemented by elements that have their own access policy.
+type ElementAccessPolicy interface {
+	AccessPolicy() AccessPolicy // Returns the access policy of the element itself, without the policies of its parents
+
+	inheritAccessPolicy(p AccessPolicy) // Adds the restrictions of the given policy to the element's own policy
+}
+
+// EffectiveAccessPolicy returns the access policy that applies to the given element.
+// This is the combination of the policies of the element and all its parents.
+func EffectiveAccessPolicy(e Element) AccessPolicy {
+	p := AccessPolicy{}
+	for ; e != nil; e = e.Parent() {
+		if ep, ok := e.(ElementAccessPolicy); ok {
+			p = p.Merge(ep.AccessPolicy())
+		}
+	}
+	return p
+}
+
+// cloneWithAccessPolicy returns a clone of the given element with the given parent and index set.
+// The clone keeps all restrictions that apply to the element at its original place in the tree, so they can't be bypassed by accessing it via another path.
+func cloneWithAccessPolicy(e Element, parent Element, index int) Element {
+	clone := e.Clone(parent, index)
+	if ep, ok := clone.(ElementAccessPolicy); ok {
+		ep.inheritAccessPolicy(EffectiveAccessPolicy(e))
+	}
+	return clone
+}
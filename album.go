@@ -25,10 +25,12 @@ type Album struct {
 	parent        Element
 	index         int
 	children      []Element
+	access        AccessPolicy
 }
 
 // Compile time check if Album implements Element.
 var _ Element = (*Album)(nil)
+var _ ElementAccessPolicy = (*Album)(nil)
 
 // Clone returns a clone with the given parent and index set
 func (a *Album) Clone(parent Element, index int) Element {
@@ -55,6 +57,15 @@ func (a *Album) Children() ([]Element, error) {
 	return a.children, nil
 }
 
+// AccessPolicy returns the access policy of the element itself.
+func (a *Album) AccessPolicy() AccessPolicy {
+	return a.access
+}
+
+func (a *Album) inheritAccessPolicy(p AccessPolicy) {
+	a.access = a.access.Merge(p)
+}
+
 // Path returns the absolute path of the element, but not the filesystem path.
 // For details see ElementPath.
 func (a *Album) Path() string {
@@ -0,0 +1,126 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// This file implements the BlurHash encoder, see https://blurha.sh.
+// A BlurHash is a short string that describes a very blurry version of an image.
+// It's decoded by the browser, see ui/static/js/blurhash.js.
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHashEncode83 appends the value as base 83 number with the given number of digits.
+func blurHashEncode83(sb *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := (value / int(math.Pow(83, float64(i)))) % 83
+		sb.WriteByte(blurHashCharacters[digit])
+	}
+}
+
+// EncodeBlurHash returns the BlurHash of an image with the given number of components in x and y direction.
+// The number of components must be between 1 and 9.
+//
+// The image should already be reduced to a few pixels, as every pixel is processed for every component.
+func EncodeBlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("invalid number of BlurHash components %dx%d", xComponents, yComponents)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid image size %dx%d for BlurHash", width, height)
+	}
+
+	// Get linear RGB values of all pixels
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{srgbDecode(float64(r) / 0xFFFF), srgbDecode(float64(g) / 0xFFFF), srgbDecode(float64(b) / 0xFFFF)}
+		}
+	}
+
+	// Calculate the factors of all cosine components
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for c := range factor {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			for c := range factor {
+				factor[c] *= normalization / float64(width*height)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	sb := new(strings.Builder)
+	blurHashEncode83(sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	// Encode the maximum amplitude of the AC components
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		blurHashEncode83(sb, quantisedMaximum, 1)
+	} else {
+		blurHashEncode83(sb, 0, 1)
+	}
+
+	// Encode the DC component
+	value := 0
+	for _, v := range factors[0] {
+		value = value<<8 + int(math.Round(srgbEncode(math.Max(0, math.Min(1, v)))*255))
+	}
+	blurHashEncode83(sb, value, 4)
+
+	// Encode the AC components
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, v := range factor {
+			signPow := math.Copysign(math.Pow(math.Abs(v/maximumValue), 0.5), v)
+			value = value*19 + int(math.Max(0, math.Min(18, math.Floor(signPow*9+9.5))))
+		}
+		blurHashEncode83(sb, value, 2)
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	solid := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	gradient := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			solid.Set(x, y, color.RGBA{200, 100, 50, 255})
+			gradient.Set(x, y, color.RGBA{uint8(x * 32), uint8(y * 40), 128, 255})
+		}
+	}
+
+	// Expected values are from a port of the reference encoder
+	tests := []struct {
+		img                      image.Image
+		xComponents, yComponents int
+		want                     string
+	}{
+		{solid, 1, 1, "00M|T9"},
+		{gradient, 4, 3, "LjF=ad3Ba|xuzONLfQnTeqf7fQf7"},
+	}
+
+	for _, test := range tests {
+		got, err := EncodeBlurHash(test.img, test.xComponents, test.yComponents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Got BlurHash %q with %dx%d components, want %q", got, test.xComponents, test.yComponents, test.want)
+		}
+	}
+
+	for _, components := range [][2]int{{0, 3}, {4, 10}} {
+		if _, err := EncodeBlurHash(solid, components[0], components[1]); err == nil {
+			t.Errorf("Invalid number of components %dx%d was accepted", components[0], components[1])
+		}
+	}
+	if _, err := EncodeBlurHash(image.NewRGBA(image.Rect(0, 0, 0, 0)), 4, 3); err == nil {
+		t.Error("Empty image was accepted")
+	}
+}
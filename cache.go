@@ -19,55 +19,254 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
-	"strconv"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nfnt/resize"
-	"golang.org/x/image/bmp"
 	"gopkg.in/yaml.v2"
 
-	"trimmer.io/go-xmp/models/dc"
-	xmpbase "trimmer.io/go-xmp/models/xmp_base"
 	"trimmer.io/go-xmp/xmp"
 )
 
 // Cache manages the on disk cache for metadata and image files.
 type Cache struct {
 	dirPath string
+	storage CacheStorage // Stores all files of the cache, see cache_storage.go
+	options CacheOptions
+
+	generationsMutex sync.Mutex
+	generations      map[string]*cacheGeneration // Cache entries that are currently being generated, by hash
+
+	memory *cacheMemory // Recently used cache entries, see cache_memory.go
+
+	decodeSlots chan struct{} // Limits the number of images that are decoded at the same time
+
+	imagesMutex   sync.Mutex
+	imagePaths    map[string][]string // Paths of images whose cache entries have been queried, by hash. Used to regenerate evicted cache entries and to find images by their hash
+	imagePathsNew map[string][]string // Paths registered while the index is rebuilt, see IndexImages. Is nil if there is no rebuild in progress
+	imageIndexRun int                 // Incremented with every rebuild of the index
+
+	// Size limit, see cache_limit.go
+	maxSize    int64
+	usageMutex sync.Mutex
+	usage      map[string]*cacheFileUsage // Size and last access of all files in the cache directory, by file name
+	usageSize  int64                      // Sum of the size of all files in the cache directory
+	evicting   bool                       // True while files are being evicted
+}
+
+// cacheGeneration is the generation of a cache entry that is currently in progress.
+// Its result is shared by all callers that need the same cache entry.
+type cacheGeneration struct {
+	done chan struct{} // Closed when the generation is finished
+	ce   *CacheEntry
+	err  error
+}
+
+// CacheOptions contains the parameters of how reduced images are generated.
+type CacheOptions struct {
+	RenditionHeights []int    // Heights of the reduced versions that are generated for every image
+	Formats          []string // Formats that are generated in addition to JPEG, see cacheFormats
+	JPEGQuality      int      // Quality of JPEG images between 1 and 100
+	WebPQuality      int      // Quality of WebP images between 1 and 100
+	MaxSize          int64    // Maximum size of the cache directory in bytes. 0 means unlimited
+	MemorySize       int64    // Maximum size of the cache entries that are held in memory in bytes. 0 disables the in-memory cache
+	Storage          string   // Type of the storage, see CacheStorageTypes. Defaults to "flat"
+	MaxPixels        int64    // Images with more pixels are not decoded, but replaced by a placeholder. 0 means unlimited
+	MaxDecodes       int      // Maximum number of images that are decoded at the same time. Defaults to the number of CPUs
 }
 
 var cache *Cache
 
+// defaultRenditionHeight is the height of the reduced image that is used when no specific size is requested.
+const defaultRenditionHeight = 1080
+
+// cacheFormat describes an image format that reduced images can be stored in.
+type cacheFormat struct {
+	mime, extension string
+	encode          func(c *Cache, w io.Writer, img image.Image, iccProfile []byte) error
+}
+
+// cacheFormats contains all formats that reduced images can be stored in.
+// JPEG is always generated, as it is supported by every browser.
+//
+// There is no AVIF encoder written in pure Go yet, so AVIF is not supported.
+var cacheFormats = map[string]cacheFormat{
+	"jpeg": {"image/jpeg", "jpg", func(c *Cache, w io.Writer, img image.Image, iccProfile []byte) error {
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: c.options.JPEGQuality}); err != nil {
+			return err
+		}
+
+		data := buf.Bytes()
+		if iccProfile != nil {
+			var err error
+			if data, err = jpegEmbedICCProfile(data, iccProfile); err != nil {
+				return err
+			}
+		}
+
+		_, err := w.Write(data)
+		return err
+	}},
+	"webp": {"image/webp", "webp", func(c *Cache, w io.Writer, img image.Image, iccProfile []byte) error {
+		return EncodeWebP(w, img, &WebPOptions{Quality: c.options.WebPQuality, ICCProfile: iccProfile})
+	}},
+}
+
 // NewCache creates a new cache for image data.
-func NewCache(path string) *Cache {
-	return &Cache{
-		dirPath: path,
+//
+// For every image a reduced version for each of the configured heights and formats will be generated.
+// Unknown formats are ignored.
+func NewCache(path string, options CacheOptions) (*Cache, error) {
+	formats := []string{}
+	for _, format := range options.Formats {
+		if _, ok := cacheFormats[format]; !ok {
+			log.Warnf("Unsupported cache format %q, ignoring it", format)
+			continue
+		}
+		if format != "jpeg" {
+			formats = append(formats, format)
+		}
+	}
+	options.Formats = formats
+
+	if options.JPEGQuality <= 0 || options.JPEGQuality > 100 {
+		options.JPEGQuality = jpeg.DefaultQuality
+	}
+	if options.WebPQuality <= 0 || options.WebPQuality > 100 {
+		options.WebPQuality = 75
+	}
+
+	if options.MaxDecodes <= 0 {
+		options.MaxDecodes = runtime.NumCPU()
+	}
+
+	if options.Storage == "" {
+		options.Storage = "flat"
 	}
+	if storageType, ok := CacheStorageTypes[options.Storage]; ok && options.MaxSize > 0 && !storageType.reclaimsSpace {
+		return nil, fmt.Errorf("Cache storage type %q doesn't free the space of removed files, so it can't be used with a size limit", options.Storage)
+	}
+	storage, err := NewCacheStorage(options.Storage, path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create cache storage: %w", err)
+	}
+
+	c := &Cache{
+		dirPath:     path,
+		storage:     storage,
+		options:     options,
+		generations: map[string]*cacheGeneration{},
+		memory:      newCacheMemory(options.MemorySize),
+		decodeSlots: make(chan struct{}, options.MaxDecodes),
+		imagePaths:  map[string][]string{},
+		maxSize:     options.MaxSize,
+		usage:       map[string]*cacheFileUsage{},
+	}
+
+	if c.maxSize > 0 {
+		c.scanUsage()
+	}
+
+	return c, nil
+}
+
+// renditionHeightsFor returns the heights of the reduced versions that are generated for an image of the given height.
+// Images are never upscaled, so any height larger than the original is replaced by the original height.
+// The result is sorted in descending order and contains no duplicates.
+func (c *Cache) renditionHeightsFor(originalHeight int) []int {
+	heights := []int{}
+	exists := map[int]bool{}
+
+	for _, height := range c.options.RenditionHeights {
+		if height > originalHeight {
+			height = originalHeight
+		}
+		if height > 0 && !exists[height] {
+			exists[height] = true
+			heights = append(heights, height)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(heights)))
+
+	return heights
+}
+
+// metadataName returns the name of the file that contains the metadata of a cache entry.
+func metadataName(hash string) string {
+	return fmt.Sprintf("%v.yaml", hash)
+}
+
+// renditionName returns the name of the file of the reduced version with the given height and format of a cache entry.
+func renditionName(hash string, height int, format string) string {
+	return fmt.Sprintf("%v-%d.%v", hash, height, cacheFormats[format].extension)
+}
+
+// watermarkedOriginalName returns the name of the file of the watermarked original image of a cache entry.
+func watermarkedOriginalName(hash string) string {
+	return fmt.Sprintf("%v-original.%v", hash, cacheFormats["jpeg"].extension)
+}
+
+// legacyRenditionName returns the name of the file of the single reduced version of a cache entry in the legacy format.
+func legacyRenditionName(hash string) string {
+	return fmt.Sprintf("%v.jpg", hash)
+}
+
+// readFile returns the content of the file with the given name from the storage.
+func (c *Cache) readFile(name string) ([]byte, error) {
+	f, _, err := c.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
 }
 
 // QueryCacheEntryHash returns a cache entry for a given hash, or an error if there is no cache element.
+//
+// Recently used cache entries are held in memory, so only the first query of an entry reads from disk.
+// The returned entry is a copy, and can be modified by the caller.
 func (c *Cache) QueryCacheEntryHash(hash string) (*CacheEntry, error) {
-	data, err := ioutil.ReadFile(filepath.Join(c.dirPath, fmt.Sprintf("%v.yaml", hash)))
+	name := metadataName(hash)
+
+	if ce, ok := c.memory.get(hash); ok {
+		ce.cache = c
+		ce.hash = hash
+		c.accessFile(name)
+		return ce, nil
+	}
+
+	data, err := c.readFile(name)
 	if err != nil {
 		return nil, err
 	}
+	c.accessFile(name)
 
 	var ce *CacheEntry
-	err = yaml.Unmarshal([]byte(data), &ce)
-	if err != nil {
-		return nil, err
+	if err := yaml.Unmarshal([]byte(data), &ce); err != nil {
+		return nil, fmt.Errorf("Couldn't parse cache entry %q: %w", hash, err)
+	}
+	if ce == nil {
+		return nil, fmt.Errorf("Cache entry %q is empty", hash)
 	}
 
 	ce.cache = c
 	ce.hash = hash
 
+	c.memory.put(hash, ce, int64(len(data)))
+
 	return ce, nil
 }
 
@@ -76,16 +275,194 @@ func (c *Cache) QueryCacheEntryHash(hash string) (*CacheEntry, error) {
 // When there is no cache entry, a new one based on the image will be generated.
 // This function will block and then return a valid cache entry, if one could be generated.
 // An error will be returned otherwise.
+//
+// If several callers request the same missing cache entry at once, it's only generated once, and all callers get the same result.
 func (c *Cache) QueryCacheEntryImage(img Image) (*CacheEntry, error) {
 	hash := img.Hash()
 
-	// Return an already existing cache entry if possible
-	if ce, err := c.QueryCacheEntryHash(hash); err == nil {
+	c.registerImage(img)
+
+	if ce, ok := c.queryValidCacheEntry(hash); ok {
 		return ce, nil
 	}
 
+	// Wait for the result if someone else is already generating this cache entry
+	c.generationsMutex.Lock()
+	if g, ok := c.generations[hash]; ok {
+		c.generationsMutex.Unlock()
+		<-g.done
+		return g.ce, g.err
+	}
+	g := &cacheGeneration{done: make(chan struct{})}
+	c.generations[hash] = g
+	c.generationsMutex.Unlock()
+
+	defer func() {
+		c.generationsMutex.Lock()
+		delete(c.generations, hash)
+		c.generationsMutex.Unlock()
+		close(g.done)
+	}()
+
+	// Another generation may have finished between the first check and now
+	if ce, ok := c.queryValidCacheEntry(hash); ok {
+		g.ce = ce
+		return g.ce, g.err
+	}
+
 	// Generate new cache entry, and return it if possible
-	return cache.PrepareAndStoreImage(img)
+	g.ce, g.err = c.PrepareAndStoreImage(img)
+	return g.ce, g.err
+}
+
+// QueryCompleteCacheEntryHash returns a cache entry for a given hash, or an error if there is no cache element.
+//
+// In contrast to QueryCacheEntryHash, entries that lack reduced images will be regenerated, as long as the image they belong to is known.
+// This is the case for evicted cache entries, see cache_limit.go.
+func (c *Cache) QueryCompleteCacheEntryHash(hash string) (*CacheEntry, error) {
+	if ce, ok := c.queryValidCacheEntry(hash); ok {
+		return ce, nil
+	}
+
+	if img := c.ImageByHash(hash); img != nil {
+		return c.QueryCacheEntryImage(img)
+	}
+
+	return c.QueryCacheEntryHash(hash)
+}
+
+// registerImage remembers the path of the image, so that it can be found when only its hash is known.
+//
+// Only the path is stored, not the image itself.
+// That way no old element trees are kept in memory, and the image is always looked up in the current tree with its current access policy.
+func (c *Cache) registerImage(img Image) {
+	element, ok := img.(Element)
+	if !ok {
+		return
+	}
+	hash, path := img.Hash(), element.Path()
+
+	c.imagesMutex.Lock()
+	defer c.imagesMutex.Unlock()
+
+	addImagePath(c.imagePaths, hash, path)
+	if c.imagePathsNew != nil {
+		addImagePath(c.imagePathsNew, hash, path)
+	}
+}
+
+// addImagePath adds the path to the paths of the given hash, if it's not already in there.
+func addImagePath(index map[string][]string, hash, path string) {
+	for _, p := range index[hash] {
+		if p == path {
+			return
+		}
+	}
+	index[hash] = append(index[hash], path)
+}
+
+// IndexImages rebuilds the index of image paths from all images inside of root.
+// Paths that were registered before and that don't exist in root anymore are removed from the index.
+//
+// The old index is used until the new one is complete.
+// If there was an error while walking through the images, the old paths are kept, as the error may be temporary.
+func (c *Cache) IndexImages(root Element) {
+	timeStart := time.Now()
+
+	index := map[string][]string{}
+	c.imagesMutex.Lock()
+	c.imageIndexRun++
+	run := c.imageIndexRun
+	c.imagePathsNew = index
+	c.imagesMutex.Unlock()
+
+	failed := false
+	WalkImages(root, func(img Image, err error) error {
+		if err != nil {
+			log.Warnf("Image index: %v", err)
+			failed = true
+			return nil
+		}
+		c.registerImage(img)
+		return nil
+	})
+
+	c.imagesMutex.Lock()
+	defer c.imagesMutex.Unlock()
+
+	// Another rebuild may have been started in the meantime, its result takes precedence
+	if c.imageIndexRun != run {
+		return
+	}
+	c.imagePathsNew = nil
+	if !failed {
+		c.imagePaths = index
+	}
+
+	log.Debugf("Indexed %v images in %v", len(index), time.Since(timeStart))
+}
+
+// ImagePaths returns the paths of all images with the given hash that are known to the cache.
+// The paths are not guaranteed to exist in the current tree, see imageByPath.
+func (c *Cache) ImagePaths(hash string) []string {
+	c.imagesMutex.Lock()
+	defer c.imagesMutex.Unlock()
+
+	return append([]string(nil), c.imagePaths[hash]...)
+}
+
+// ImageByHash returns an image with the given hash from the current tree, or nil if it's not known.
+// Images are known once their cache entry has been queried, or once they have been indexed by IndexImages.
+func (c *Cache) ImageByHash(hash string) Image {
+	for _, path := range c.ImagePaths(hash) {
+		if img := imageByPath(path, hash); img != nil {
+			return img
+		}
+	}
+	return nil
+}
+
+// imageByPath returns the image at the given path of the current tree, or nil if there is no image with the given hash at that path.
+func imageByPath(path, hash string) Image {
+	element, err := RootElement.Traverse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil
+	}
+	img, ok := element.(Image)
+	if !ok || img.Hash() != hash {
+		return nil
+	}
+	return img
+}
+
+// queryValidCacheEntry returns an already existing cache entry, if there is one that is complete.
+// Entries that lack some of the configured reduced versions or formats are not considered to be complete.
+// The same applies to entries of a different format version, and to corrupted entries.
+func (c *Cache) queryValidCacheEntry(hash string) (*CacheEntry, bool) {
+	ce, err := c.QueryCacheEntryHash(hash)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Cache entry %q is invalid and will be regenerated: %v", hash, err)
+		}
+		return nil, false
+	}
+	if ce.Version != cacheEntryVersion {
+		return nil, false
+	}
+
+	// Placeholders of oversized images are regenerated once the image is within the pixel limit
+	if ce.Oversized {
+		if !c.exceedsPixelLimit(ce.Width, ce.Height) || len(ce.Renditions) == 0 {
+			return nil, false
+		}
+		return ce, true
+	}
+
+	if !ce.hasRenditions(c.renditionHeightsFor(ce.Height), c.options.Formats) {
+		return nil, false
+	}
+
+	return ce, true
 }
 
 // StoreCacheEntry saves a cache entry to disk.
@@ -95,85 +472,100 @@ func (c *Cache) StoreCacheEntry(hash string, ce *CacheEntry) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(c.dirPath, fmt.Sprintf("%v.yaml", hash)), data, 0644)
-	if err != nil {
+	name := metadataName(hash)
+	if err := c.storage.Write(name, data); err != nil {
 		return err
 	}
+	c.trackFile(name, int64(len(data)))
+	c.memory.put(hash, ce, int64(len(data)))
 
 	return nil
 }
 
 // PrepareAndStoreImage takes an image file, prepares it for caching and writes it into the cache.
+//
+// This doesn't check for concurrent generations of the same cache entry, use QueryCacheEntryImage instead.
 func (c *Cache) PrepareAndStoreImage(imgElement Image) (*CacheEntry, error) {
 	timeStart := time.Now()
 	hash := imgElement.Hash()
 
-	// Rely on the fact that ImageSizeOriginal should not be cached
-	file, _, _, err := imgElement.FileContent()
+	// Read the dimensions first, decoding huge images could exhaust the memory
+	configFile, _, _, err := imgElement.FileContent()
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get original image from %v: %w", imgElement, err)
 	}
-	defer file.Close()
-
-	img, _, err := image.Decode(file)
+	config, _, err := image.DecodeConfig(configFile)
+	configFile.Close()
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't decode image %v: %w", imgElement, err)
+		return nil, fmt.Errorf("Couldn't decode image configuration of %v: %w", imgElement, err)
 	}
 
-	imgReduced := resize.Resize(0, 1080, img, resize.Lanczos3)
-	imgNano := resize.Resize(0, 8, img, resize.Lanczos3)
-
-	// Encode uses a Writer, use a Buffer if you need the raw []byte
-	imgNanoBuf := new(bytes.Buffer)
-	if err := bmp.Encode(imgNanoBuf, imgNano); err != nil {
-		return nil, fmt.Errorf("Couldn't encode image %v as nano BMP: %w", imgElement, err)
+	ce := &CacheEntry{
+		cache:   c,
+		hash:    hash,
+		Width:   config.Width,
+		Height:  config.Height,
+		Version: cacheEntryVersion,
 	}
 
-	ce := &CacheEntry{
-		cache:      c,
-		hash:       hash,
-		NanoBitmap: imgNanoBuf.String(),
-		Width:      img.Bounds().Dx(),
-		Height:     img.Bounds().Dy(),
+	if c.exceedsPixelLimit(config.Width, config.Height) {
+		log.Warnf("Image %v has %v × %v pixels, which exceeds the limit of %v pixels. Showing a placeholder instead", imgElement, config.Width, config.Height, c.options.MaxPixels)
+		ce.Oversized = true
+		if err := ce.generatePlaceholder(); err != nil {
+			return nil, fmt.Errorf("Couldn't generate placeholder for image %v: %w", imgElement, err)
+		}
+	} else if err := ce.generateRenditions(imgElement); err != nil {
+		return nil, err
 	}
 
-	if err := ce.SetReducedImage(hash, imgReduced); err != nil {
-		return nil, fmt.Errorf("Couldn't store image %v to cache: %w", imgElement, err)
+	// Remove the reduced image of the legacy single size format, if there is any
+	if err := c.storage.Remove(legacyRenditionName(hash)); err == nil {
+		c.untrackFile(legacyRenditionName(hash))
 	}
 
-	// Get metadata
-	file, _, _, err = imgElement.FileContent()
+	// Get metadata, see metadata.go for the precedence of the different sources
+	file, _, mime, err := imgElement.FileContent()
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get original image from %v: %w", imgElement, err)
 	}
 	defer file.Close()
 
-	if d, err := xmp.Scan(file); err == nil {
-		// Retrieve some values from the XMP namespace
-		xmpNS := d.FindNs("xmp", "http://ns.adobe.com/xap/1.0/")
-		if xmpModel, ok := d.FindModel(xmpNS).(*xmpbase.XmpBase); ok {
-			// Rating
-			if rating, err := xmpModel.GetTag("Rating"); err == nil {
-				if ratingInt, err := strconv.ParseInt(rating, 10, 0); err == nil {
-					ce.Rating = int(ratingInt)
-				}
-			}
+	if mime == "image/jpeg" {
+		iptcFile, _, _, err := imgElement.FileContent()
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get original image from %v: %w", imgElement, err)
 		}
+		defer iptcFile.Close()
 
-		// Retrieve some values from the DC namespace
-		dcNS := d.FindNs("dc", "http://purl.org/dc/elements/1.1/")
-		if dcModel, ok := d.FindModel(dcNS).(*dc.DublinCore); ok {
-			// Title
-			ce.Title = dcModel.Title.Default()
-			ce.Tags = []string(dcModel.Subject)
-			ce.Creators = []string(dcModel.Creator)
-			ce.Description = dcModel.Description.Default()
+		if id, err := ReadJPEGIPTC(iptcFile); err != nil {
+			log.Warnf("Couldn't read and parse IPTC metadata from %v: %v", imgElement, err)
+		} else if id != nil {
+			ce.applyIPTC(id)
 		}
+	}
 
+	if d, err := xmp.Scan(file); err == nil {
+		ce.applyXMP(d)
 	} else {
 		log.Warnf("Couldn't read and parse metadata from %v: %v", imgElement, err)
 	}
 
+	// Metadata from sidecar files takes precedence over embedded metadata
+	if sidecarElement, ok := imgElement.(ImageSidecar); ok {
+		sidecar, err := sidecarElement.SidecarContent()
+		if err != nil {
+			log.Warnf("Couldn't open sidecar file of %v: %v", imgElement, err)
+		} else if sidecar != nil {
+			defer sidecar.Close()
+
+			if d, err := xmp.Read(sidecar); err == nil {
+				ce.applyXMP(d)
+			} else {
+				log.Warnf("Couldn't read and parse sidecar metadata of %v: %v", imgElement, err)
+			}
+		}
+	}
+
 	// Store cache entry
 	if err := c.StoreCacheEntry(hash, ce); err != nil {
 		log.Warnf("Couldn't store cache entry for image %v: %v", imgElement, err)
@@ -184,12 +576,155 @@ func (c *Cache) PrepareAndStoreImage(imgElement Image) (*CacheEntry, error) {
 	return ce, nil
 }
 
+// imageColorConversion returns how the colors of the decoded image have to be handled, based on its embedded color profile.
+// See profileColorConversion for details.
+func imageColorConversion(imgElement Image) (convertColors func(image.Image) image.Image, embedProfile []byte) {
+	profile, err := readImageICCProfile(imgElement)
+	if err != nil {
+		log.Warnf("Couldn't read ICC profile of %v: %v", imgElement, err)
+		return func(img image.Image) image.Image { return img }, nil
+	}
+
+	convertColors, embedProfile, err = profileColorConversion(profile)
+	if err != nil {
+		log.Warnf("Ignoring ICC profile of %v: %v", imgElement, err)
+	}
+
+	return convertColors, embedProfile
+}
+
+// profileColorConversion returns how the colors of a decoded image with the given color profile have to be handled.
+// Matrix/TRC profiles are converted to sRGB, other RGB profiles are returned so that they can be embedded into the reduced images.
+//
+// Reduced images are always RGB, so profiles of any other color space, like CMYK or grayscale, can't be embedded.
+// They are dropped, and an error describing why is returned.
+func profileColorConversion(profile []byte) (convertColors func(image.Image) image.Image, embedProfile []byte, err error) {
+	convertColors = func(img image.Image) image.Image { return img }
+	if profile == nil {
+		return convertColors, nil, nil
+	}
+
+	p, err := ParseICCProfile(profile)
+	switch {
+	case err == nil && p.IsSRGB():
+	case err == nil:
+		convertColors = func(img image.Image) image.Image { return p.ConvertToSRGB(img) }
+	case errors.Is(err, ErrICCProfileUnsupported) && iccProfileColorSpace(profile) == "RGB ":
+		embedProfile = profile
+	case errors.Is(err, ErrICCProfileUnsupported):
+		return convertColors, nil, fmt.Errorf("profile with color space %q can't be embedded into RGB images", iccProfileColorSpace(profile))
+	default:
+		return convertColors, nil, fmt.Errorf("Couldn't parse ICC profile: %w", err)
+	}
+
+	return convertColors, embedProfile, nil
+}
+
+// exceedsPixelLimit returns whether an image with the given dimensions is too large to be decoded.
+func (c *Cache) exceedsPixelLimit(width, height int) bool {
+	return c.options.MaxPixels > 0 && int64(width)*int64(height) > c.options.MaxPixels
+}
+
+// generateRenditions decodes the given image and stores all its reduced versions in the cache.
+// The number of concurrent calls is limited, as every decoded image is held in memory completely.
+func (ce *CacheEntry) generateRenditions(imgElement Image) error {
+	ce.cache.decodeSlots <- struct{}{}
+	defer func() { <-ce.cache.decodeSlots }()
+
+	// Rely on the fact that ImageSizeOriginal should not be cached
+	file, _, _, err := imgElement.FileContent()
+	if err != nil {
+		return fmt.Errorf("Couldn't get original image from %v: %w", imgElement, err)
+	}
+	defer file.Close()
+
+	timeStart := time.Now()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't decode image %v: %w", imgElement, err)
+	}
+	durationDecode := time.Since(timeStart)
+
+	convertColors, embedProfile := imageColorConversion(imgElement)
+	watermark := imageWatermark(imgElement)
+
+	// The decoded dimensions are authoritative, in case they differ from the image configuration
+	ce.Width, ce.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Generate all reduced versions, from the largest to the smallest.
+	// Every version is resized from the previous one, which is a lot faster than resizing the original each time
+	var durationResize, durationEncode time.Duration
+	imgSource := img
+	for _, height := range ce.cache.renditionHeightsFor(ce.Height) {
+		timeStart = time.Now()
+		imgReduced := ReduceImage(imgSource, height)
+		imgSource = imgReduced
+		durationResize += time.Since(timeStart)
+
+		timeStart = time.Now()
+		imgFinal := convertColors(imgReduced)
+		if watermark != nil {
+			imgFinal = watermark.Apply(imgFinal)
+		}
+		if err := ce.SetReducedImage(imgFinal, embedProfile); err != nil {
+			return fmt.Errorf("Couldn't store image %v to cache: %w", imgElement, err)
+		}
+		durationEncode += time.Since(timeStart)
+	}
+
+	// Use more components along the longer side of the image.
+	// The smallest reduced version is good enough as source of the BlurHash
+	timeStart = time.Now()
+	xComponents, yComponents := 4, 3
+	if ce.Width < ce.Height {
+		xComponents, yComponents = 3, 4
+	}
+	imgPlaceholder := resize.Resize(0, 32, imgSource, resize.Lanczos3)
+	if ce.BlurHash, err = EncodeBlurHash(convertColors(imgPlaceholder), xComponents, yComponents); err != nil {
+		return fmt.Errorf("Couldn't generate BlurHash of image %v: %w", imgElement, err)
+	}
+	durationBlurHash := time.Since(timeStart)
+
+	log.Debugf("Generated reduced images of %v (%v × %v): Decoding %v, resizing %v, encoding %v, BlurHash %v", imgElement, ce.Width, ce.Height, durationDecode, durationResize, durationEncode, durationBlurHash)
+
+	return nil
+}
+
+// generatePlaceholder stores a plain gray image with the aspect ratio of the original image as the only reduced version.
+// This is used for images that are too large to be decoded.
+func (ce *CacheEntry) generatePlaceholder() error {
+	heights := ce.cache.renditionHeightsFor(ce.Height)
+	if len(heights) == 0 {
+		return fmt.Errorf("There are no rendition heights configured")
+	}
+	height := heights[len(heights)-1]
+	width := int(int64(ce.Width) * int64(height) / int64(ce.Height))
+	if width < 1 {
+		width = 1
+	}
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+
+	var err error
+	if ce.BlurHash, err = EncodeBlurHash(img, 1, 1); err != nil {
+		return fmt.Errorf("Couldn't generate BlurHash: %w", err)
+	}
+
+	return ce.SetReducedImage(img, nil)
+}
+
 // CacheEntry contains the metadata of an image.
 type CacheEntry struct {
 	cache         *Cache
 	hash          string // The hash of the cache entry
-	NanoBitmap    string // Byteslice of a BMP file containing a really small version of the image
+	BlurHash      string `yaml:",omitempty"` // BlurHash of the image that is used as placeholder
 	Width, Height int
+	Renditions    []CacheRendition // List of reduced versions of the image
+	Evicted       bool             `yaml:",omitempty"` // True if the reduced versions have been deleted because of the size limit of the cache
+	Oversized     bool             `yaml:",omitempty"` // True if the image exceeds the pixel limit, and the only reduced version is a placeholder
 
 	// Metadata
 	Title       string   // Title based on metadata
@@ -197,57 +732,153 @@ type CacheEntry struct {
 	Rating      int      // -1: Rejected, 0: Unrated, 1-5: Rated
 	Tags        []string // List of tags
 	Creators    []string // List of creators
+	Copyright   string   // Copyright notice
+	City        string   // City the image was taken in
+	Country     string   // Country the image was taken in
+
+	// Version of the format of the cache entry, see cacheEntryVersion.
+	// This has to be the last field, so it's missing if the file got truncated
+	Version int
 }
 
-// ReducedImagePath returns the filepath to the reduced version of the image.
-func (ce *CacheEntry) ReducedImagePath() string {
-	if ce.cache == nil {
-		return ""
+// cacheEntryVersion is the current version of the format of cache entries.
+// Cache entries with a different version are regenerated.
+//
+// History:
+// 0: Entries without version, which may have been written non-atomically.
+// 1: Current format.
+const cacheEntryVersion = 1
+
+// CacheRendition describes a reduced version of a cached image.
+type CacheRendition struct {
+	Width, Height int
+	Formats       []string         `yaml:",omitempty"` // Formats that are available in addition to JPEG
+	Sizes         map[string]int64 `yaml:",omitempty"` // File size of every format, including JPEG. Entries written by older versions don't have this
+}
+
+// hasFormat returns whether the reduced version is available in the given format.
+func (cr CacheRendition) hasFormat(format string) bool {
+	if format == "jpeg" {
+		return true
+	}
+	for _, f := range cr.Formats {
+		if f == format {
+			return true
+		}
 	}
-	return filepath.Join(ce.cache.dirPath, fmt.Sprintf("%v.jpg", ce.hash))
+
+	return false
 }
 
-// SetReducedImage saves the image as reduced version to the disk.
-func (ce *CacheEntry) SetReducedImage(hash string, img image.Image) error {
+// hasRenditions returns whether the cache entry contains reduced versions of all the given heights, each in all the given formats.
+func (ce *CacheEntry) hasRenditions(heights []int, formats []string) bool {
+	for _, height := range heights {
+		found := false
+		for _, rendition := range ce.Renditions {
+			if rendition.Height == height {
+				found = true
+				for _, format := range formats {
+					found = found && rendition.hasFormat(format)
+				}
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Rendition returns the reduced version that fits best to the given height.
+// This is the smallest version that is at least as high as the given height, or the largest version if there is none.
+//
+// The boolean is false if there is no reduced version at all.
+func (ce *CacheEntry) Rendition(height int) (CacheRendition, bool) {
+	var best CacheRendition
+	found := false
+
+	for _, rendition := range ce.Renditions {
+		switch {
+		case !found:
+			best, found = rendition, true
+		case best.Height < height && rendition.Height > best.Height:
+			best = rendition
+		case rendition.Height >= height && rendition.Height < best.Height:
+			best = rendition
+		}
+	}
+
+	return best, found
+}
+
+// ReducedImageName returns the name of the file of the reduced version of the image with the given height and format.
+func (ce *CacheEntry) ReducedImageName(height int, format string) string {
+	return renditionName(ce.hash, height, format)
+}
+
+// SetReducedImage saves the image as reduced version to the disk, and adds it to the list of reduced versions.
+// The image is stored as JPEG, and in every additional format the cache is configured for.
+//
+// If iccProfile is not nil, the profile will be embedded into the reduced image.
+func (ce *CacheEntry) SetReducedImage(img image.Image, iccProfile []byte) error {
 	if ce.cache == nil {
 		return fmt.Errorf("Cache entry doesn't contain valid pointer to cache")
 	}
 
-	f, err := os.Create(ce.ReducedImagePath())
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	rendition := CacheRendition{Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), Sizes: map[string]int64{}}
 
-	err = jpeg.Encode(f, img, nil)
-	if err != nil {
-		return err
+	for _, format := range append([]string{"jpeg"}, ce.cache.options.Formats...) {
+		buf := new(bytes.Buffer)
+		if err := cacheFormats[format].encode(ce.cache, buf, img, iccProfile); err != nil {
+			return fmt.Errorf("Couldn't encode image as %v: %w", format, err)
+		}
+
+		name := renditionName(ce.hash, rendition.Height, format)
+		if err := ce.cache.storage.Write(name, buf.Bytes()); err != nil {
+			return err
+		}
+		ce.cache.trackFile(name, int64(buf.Len()))
+		rendition.Sizes[format] = int64(buf.Len())
+
+		if format != "jpeg" {
+			rendition.Formats = append(rendition.Formats, format)
+		}
 	}
 
+	ce.Renditions = append(ce.Renditions, rendition)
+
 	return nil
 }
 
-// ReducedImage returns the reduced version of the cached image.
-func (ce *CacheEntry) ReducedImage() (r io.ReadCloser, size int64, mime string, err error) {
+// ReducedImage returns the reduced version of the cached image that fits best to the given height.
+// See Rendition for details.
+//
+// The first of the given formats that is available and smaller than the JPEG version will be returned, JPEG is used if there is none.
+// Formats whose size isn't known are never used.
+func (ce *CacheEntry) ReducedImage(height int, formats []string) (r io.ReadSeekCloser, info CacheFileInfo, mime string, err error) {
 	if ce.cache == nil {
-		return nil, 0, "", fmt.Errorf("Cache entry doesn't contain valid pointer to cache")
+		return nil, CacheFileInfo{}, "", fmt.Errorf("Cache entry doesn't contain valid pointer to cache")
 	}
 
-	f, err := os.Open(ce.ReducedImagePath())
-	if err != nil {
-		return nil, 0, "", err
+	rendition, _ := ce.Rendition(height)
+
+	format := "jpeg"
+	for _, f := range formats {
+		size, ok := rendition.Sizes[f]
+		if ok && rendition.hasFormat(f) && size < rendition.Sizes["jpeg"] {
+			format = f
+			break
+		}
 	}
-	stat, err := f.Stat()
+
+	name := ce.ReducedImageName(rendition.Height, format)
+	f, info, err := ce.cache.storage.Open(name)
 	if err != nil {
-		return nil, 0, "", err
+		return nil, CacheFileInfo{}, "", err
 	}
-	return f, stat.Size(), "image/jpeg", err
-}
+	ce.cache.accessFile(name)
 
-// NanoImage returns a really small version of the cached image.
-//
-// It's only a few pixels in legnth and width to be suitable for embedding.
-func (ce *CacheEntry) NanoImage() (r io.ReadCloser, size int64, mime string, err error) {
-	r = ioutil.NopCloser(bytes.NewReader([]byte(ce.NanoBitmap)))
-	return r, int64(len(ce.NanoBitmap)), "image/bmp", nil
+	return f, info, cacheFormats[format].mime, nil
 }
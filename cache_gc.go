@@ -0,0 +1,151 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand("gc", "Delete cache entries of images that don't exist anymore. Use -dry-run to only list them", func(args []string) error {
+		flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+		dryRun := flags.Bool("dry-run", false, "Only report what would be deleted")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+
+		_, err := cache.CollectGarbage(RootElement, *dryRun)
+		return err
+	})
+}
+
+// CacheGCResult contains the files that were deleted by a garbage collection, or that would have been deleted in dry-run mode.
+type CacheGCResult struct {
+	Files []string // Names of the orphaned files
+	Size  int64    // Total size of the orphaned files in bytes
+}
+
+// cacheFileHash returns the hash of a file in the cache directory, based on its name.
+// The boolean is false if the file doesn't belong to a cache entry.
+//
+// Possible file names are {hash}.yaml, {hash}.jpg and {hash}-{height}.{extension}.
+func cacheFileHash(name string) (string, bool) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	known := ext == ".yaml"
+	for _, format := range cacheFormats {
+		known = known || ext == "."+format.extension
+	}
+	if !known {
+		return "", false
+	}
+
+	hash := strings.SplitN(base, "-", 2)[0]
+	if !isAlphanumeric(hash) {
+		return "", false
+	}
+
+	return hash, true
+}
+
+// CollectGarbage deletes all files of cache entries that don't belong to any image inside of root.
+// In dry-run mode, the files are only listed, but not deleted.
+//
+// Nothing is deleted if there was an error while walking through the images, as this may be a temporary problem with a source.
+// Files that have been modified after the garbage collection started are ignored, as they may belong to sources that were just added.
+func (c *Cache) CollectGarbage(root Element, dryRun bool) (CacheGCResult, error) {
+	var result CacheGCResult
+	timeStart := time.Now()
+
+	// Get the hashes of all reachable images
+	hashes := map[string]bool{}
+	err := WalkImages(root, func(img Image, err error) error {
+		if err != nil {
+			return err
+		}
+		hashes[img.Hash()] = true
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("Couldn't get all images, aborting cache garbage collection: %w", err)
+	}
+
+	files, err := c.storage.List()
+	if err != nil {
+		return result, fmt.Errorf("Couldn't list files in cache storage: %w", err)
+	}
+
+	for _, file := range files {
+		if file.ModTime.After(timeStart) {
+			continue
+		}
+
+		hash, ok := cacheFileHash(file.Name)
+		if !ok || hashes[hash] {
+			continue
+		}
+
+		if dryRun {
+			log.Infof("Cache garbage collection: Would delete %q", file.Name)
+		} else if err := c.storage.Remove(file.Name); err != nil {
+			log.Warnf("Cache garbage collection: Couldn't delete %q: %v", file.Name, err)
+			continue
+		} else {
+			c.untrackFile(file.Name)
+			c.memory.remove(hash)
+			log.Debugf("Cache garbage collection: Deleted %q", file.Name)
+		}
+
+		result.Files = append(result.Files, file.Name)
+		result.Size += file.Size
+	}
+
+	// All content digests of existing images have just been used, so the unused ones belong to files that don't exist anymore
+	if !dryRun {
+		if err := contentHashes.Compact(); err != nil {
+			log.Warnf("Cache garbage collection: Couldn't compact content digests: %v", err)
+		}
+	}
+
+	if dryRun {
+		log.Infof("Cache garbage collection: Would delete %v files with %v bytes of %v reachable images", len(result.Files), result.Size, len(hashes))
+	} else {
+		log.Infof("Cache garbage collection: Deleted %v files with %v bytes in %v", len(result.Files), result.Size, time.Since(timeStart).Round(time.Millisecond))
+	}
+
+	return result, nil
+}
+
+// StartGarbageCollection runs the garbage collection periodically in the background, with the given interval between runs.
+func (c *Cache) StartGarbageCollection(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := c.CollectGarbage(RootElement, false); err != nil {
+				log.Errorf("Cache garbage collection failed: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file implements the size limit of the cache.
+//
+// The size and last access time of every file in the cache storage is tracked.
+// When the cache grows larger than the limit, the reduced images of the least recently used cache entries are deleted.
+// The metadata of these entries stays, and is only deleted if deleting reduced images isn't enough.
+// Cache entries without reduced images are regenerated on their next access, see QueryCacheEntryImage.
+
+// cacheLowWaterMark is the fraction of the size limit that the cache is reduced to when the limit is exceeded.
+// This prevents evicting files on every write.
+const cacheLowWaterMark = 0.9
+
+// cacheFileUsage contains the size and last access time of a file in the cache storage.
+type cacheFileUsage struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// scanUsage reads the size and modification time of all files that are already in the cache storage.
+func (c *Cache) scanUsage() {
+	files, err := c.storage.List()
+	if err != nil {
+		log.Warnf("Couldn't list files in cache storage: %v", err)
+		return
+	}
+
+	c.usageMutex.Lock()
+	for _, file := range files {
+		c.usage[file.Name] = &cacheFileUsage{size: file.Size, lastAccess: file.ModTime}
+		c.usageSize += file.Size
+	}
+	c.usageMutex.Unlock()
+
+	c.enforceSizeLimit()
+}
+
+// trackFile records that the file with the given name has been written with the given size.
+// This may evict other files from the cache.
+func (c *Cache) trackFile(name string, size int64) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.usageMutex.Lock()
+	if usage, ok := c.usage[name]; ok {
+		c.usageSize -= usage.size
+	}
+	c.usage[name] = &cacheFileUsage{size: size, lastAccess: time.Now()}
+	c.usageSize += size
+	c.usageMutex.Unlock()
+
+	c.enforceSizeLimit()
+}
+
+// accessFile records that the file with the given name has been read.
+func (c *Cache) accessFile(name string) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	if usage, ok := c.usage[name]; ok {
+		usage.lastAccess = time.Now()
+	}
+}
+
+// untrackFile records that the file with the given name has been deleted.
+func (c *Cache) untrackFile(name string) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	if usage, ok := c.usage[name]; ok {
+		c.usageSize -= usage.size
+		delete(c.usage, name)
+	}
+}
+
+// enforceSizeLimit starts to evict files in the background, if the cache is larger than its size limit.
+func (c *Cache) enforceSizeLimit() {
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	if c.usageSize <= c.maxSize || c.evicting {
+		return
+	}
+	c.evicting = true
+
+	go func() {
+		c.evict()
+
+		c.usageMutex.Lock()
+		c.evicting = false
+		c.usageMutex.Unlock()
+	}()
+}
+
+// cacheEvictionCandidate is a cache entry whose files can be evicted.
+type cacheEvictionCandidate struct {
+	hash       string
+	files      []string // Names of the files that are evicted together
+	lastAccess time.Time
+}
+
+// evictionCandidates returns the cache entries sorted by their last access, oldest first.
+// Either the reduced images or the metadata files of the entries are returned.
+func (c *Cache) evictionCandidates(metadata bool) []*cacheEvictionCandidate {
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	byHash := map[string]*cacheEvictionCandidate{}
+	for name, usage := range c.usage {
+		if strings.HasSuffix(name, ".yaml") != metadata {
+			continue
+		}
+		hash, _ := cacheFileHash(name)
+		candidate, ok := byHash[hash]
+		if !ok {
+			candidate = &cacheEvictionCandidate{hash: hash}
+			byHash[hash] = candidate
+		}
+		candidate.files = append(candidate.files, name)
+		if usage.lastAccess.After(candidate.lastAccess) {
+			candidate.lastAccess = usage.lastAccess
+		}
+	}
+
+	candidates := make([]*cacheEvictionCandidate, 0, len(byHash))
+	for _, candidate := range byHash {
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastAccess.Before(candidates[j].lastAccess) })
+
+	return candidates
+}
+
+// belowLowWaterMark returns whether the cache has been reduced enough.
+func (c *Cache) belowLowWaterMark() bool {
+	c.usageMutex.Lock()
+	defer c.usageMutex.Unlock()
+
+	return float64(c.usageSize) <= float64(c.maxSize)*cacheLowWaterMark
+}
+
+// isEvicted returns whether the reduced images of the cache entry with the given hash have been evicted.
+func (c *Cache) isEvicted(hash string) bool {
+	ce, err := c.QueryCacheEntryHash(hash)
+	return err == nil && ce.Evicted
+}
+
+// isGenerating returns whether the cache entry with the given hash is currently being generated.
+func (c *Cache) isGenerating(hash string) bool {
+	c.generationsMutex.Lock()
+	defer c.generationsMutex.Unlock()
+
+	_, ok := c.generations[hash]
+	return ok
+}
+
+// evict deletes the least recently used files until the cache is below its low water mark.
+// The reduced images are deleted first, the metadata only if that's not enough.
+func (c *Cache) evict() {
+	timeStart := time.Now()
+	evicted := 0
+
+	for _, metadata := range []bool{false, true} {
+		for _, candidate := range c.evictionCandidates(metadata) {
+			if c.belowLowWaterMark() {
+				break
+			}
+			if c.isGenerating(candidate.hash) {
+				continue
+			}
+
+			// Mark the entry as incomplete before deleting its reduced images, so it will be regenerated on its next access
+			if !metadata {
+				if ce, err := c.QueryCacheEntryHash(candidate.hash); err == nil {
+					ce.Renditions, ce.Evicted = nil, true
+					if err := c.StoreCacheEntry(candidate.hash, ce); err != nil {
+						log.Warnf("Couldn't update cache entry %q: %v", candidate.hash, err)
+						continue
+					}
+				}
+			}
+
+			for _, name := range candidate.files {
+				if err := c.storage.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Warnf("Couldn't evict %q from cache: %v", name, err)
+					continue
+				}
+				c.untrackFile(name)
+				if metadata {
+					c.memory.remove(candidate.hash)
+				}
+				evicted++
+			}
+		}
+	}
+
+	log.Debugf("Evicted %v files from the cache in %v", evicted, time.Since(timeStart).Round(time.Millisecond))
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheMemory keeps the most recently used cache entries in memory, so they don't have to be read from disk on every query.
+// The total size of the entries is limited, the least recently used entries are dropped first.
+// The size of an entry is approximated by the size of its serialized form.
+type cacheMemory struct {
+	mutex   sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element // Elements of lru, by hash
+	lru     *list.List               // List of *cacheMemoryEntry, most recently used first
+	hits    uint64
+	misses  uint64
+}
+
+type cacheMemoryEntry struct {
+	hash string
+	ce   CacheEntry
+	size int64 // Approximated size of the entry in bytes
+}
+
+// CacheMemoryStats contains statistics of the in-memory cache.
+type CacheMemoryStats struct {
+	Entries int    `json:"entries"` // Number of cache entries that are currently held in memory
+	Size    int64  `json:"size"`    // Approximated size of all cache entries in memory in bytes
+	MaxSize int64  `json:"maxSize"` // Maximum size of all cache entries in memory in bytes
+	Hits    uint64 `json:"hits"`    // Number of queries that could be answered from memory
+	Misses  uint64 `json:"misses"`  // Number of queries that had to read from disk
+}
+
+func newCacheMemory(maxSize int64) *cacheMemory {
+	return &cacheMemory{
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cache entry with the given hash, if it's in memory.
+func (cm *cacheMemory) get(hash string) (*CacheEntry, bool) {
+	if cm.maxSize <= 0 {
+		return nil, false
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	element, ok := cm.entries[hash]
+	if !ok {
+		cm.misses++
+		return nil, false
+	}
+	cm.hits++
+	cm.lru.MoveToFront(element)
+
+	// Return a copy, so the caller can modify it
+	ce := element.Value.(*cacheMemoryEntry).ce.deepCopy()
+	return &ce, true
+}
+
+// put stores a copy of the cache entry in memory.
+// size is the approximated size of the entry in bytes, like the size of its serialized form.
+func (cm *cacheMemory) put(hash string, ce *CacheEntry, size int64) {
+	if cm.maxSize <= 0 {
+		return
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if element, ok := cm.entries[hash]; ok {
+		entry := element.Value.(*cacheMemoryEntry)
+		cm.size += size - entry.size
+		entry.ce, entry.size = ce.deepCopy(), size
+		cm.lru.MoveToFront(element)
+	} else {
+		cm.entries[hash] = cm.lru.PushFront(&cacheMemoryEntry{hash: hash, ce: ce.deepCopy(), size: size})
+		cm.size += size
+	}
+
+	// This also drops the new entry, if it's larger than the limit by itself
+	for cm.size > cm.maxSize {
+		cm.removeElement(cm.lru.Back())
+	}
+}
+
+// deepCopy returns a copy of the cache entry that doesn't share any slices with the original.
+func (ce *CacheEntry) deepCopy() CacheEntry {
+	result := *ce
+
+	if ce.Renditions != nil {
+		result.Renditions = make([]CacheRendition, len(ce.Renditions))
+		for i, rendition := range ce.Renditions {
+			rendition.Formats = append([]string(nil), rendition.Formats...)
+			if rendition.Sizes != nil {
+				sizes := make(map[string]int64, len(rendition.Sizes))
+				for format, size := range rendition.Sizes {
+					sizes[format] = size
+				}
+				rendition.Sizes = sizes
+			}
+			result.Renditions[i] = rendition
+		}
+	}
+	result.Tags = append([]string(nil), ce.Tags...)
+	result.Creators = append([]string(nil), ce.Creators...)
+
+	return result
+}
+
+// remove drops the cache entry with the given hash from memory.
+func (cm *cacheMemory) remove(hash string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if element, ok := cm.entries[hash]; ok {
+		cm.removeElement(element)
+	}
+}
+
+// removeElement drops the given element of the LRU list from memory.
+// The mutex has to be locked by the caller.
+func (cm *cacheMemory) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheMemoryEntry)
+	cm.lru.Remove(element)
+	delete(cm.entries, entry.hash)
+	cm.size -= entry.size
+}
+
+// stats returns the current statistics.
+func (cm *cacheMemory) stats() CacheMemoryStats {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	return CacheMemoryStats{
+		Entries: cm.lru.Len(),
+		Size:    cm.size,
+		MaxSize: cm.maxSize,
+		Hits:    cm.hits,
+		Misses:  cm.misses,
+	}
+}
+
+// MemoryStats returns statistics of the in-memory cache of the metadata.
+func (c *Cache) MemoryStats() CacheMemoryStats {
+	return c.memory.stats()
+}
@@ -0,0 +1,501 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStorage stores the files of the cache, like the metadata and reduced images of cache entries.
+// Files are addressed by their name, which always starts with the hash of the cache entry they belong to.
+//
+// Writes must be atomic: After a crash, a file must either contain its old or its new content.
+//
+// Errors of files that don't exist must wrap os.ErrNotExist.
+type CacheStorage interface {
+	Open(name string) (io.ReadSeekCloser, CacheFileInfo, error) // Opens the file with the given name for reading
+	Write(name string, data []byte) error                       // Creates or replaces the file with the given name
+	Remove(name string) error                                   // Deletes the file with the given name
+	List() ([]CacheFileInfo, error)                             // Returns all files in the storage
+	Close() error                                               // Releases any resources of the storage
+}
+
+// cacheStorageTruncater is implemented by cache storages that don't reclaim the space of removed files.
+// Truncate frees all space of the storage, but only if it doesn't contain any files anymore.
+type cacheStorageTruncater interface {
+	Truncate() error
+}
+
+// CacheFileInfo describes a file in a cache storage.
+type CacheFileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// CacheStorageType represents a type of a cache storage.
+type CacheStorageType struct {
+	create        func(dirPath string) (CacheStorage, error) // Create an instance of the storage inside the given directory
+	reclaimsSpace bool                                       // Whether removing files frees their disk space. Storage types that don't can't be used with a size limit
+}
+
+// CacheStorageTypes contains all possible cache storage types.
+var CacheStorageTypes = map[string]CacheStorageType{}
+
+func registerCacheStorageType(name string, create func(dirPath string) (CacheStorage, error), reclaimsSpace bool) {
+	CacheStorageTypes[name] = CacheStorageType{
+		create:        create,
+		reclaimsSpace: reclaimsSpace,
+	}
+}
+
+// NewCacheStorage returns a new instance of the cache storage type with the given name.
+func NewCacheStorage(typeName, dirPath string) (CacheStorage, error) {
+	storageType, ok := CacheStorageTypes[typeName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cache storage type %q", typeName)
+	}
+
+	return storageType.create(dirPath)
+}
+
+func init() {
+	registerCacheStorageType("flat", func(dirPath string) (CacheStorage, error) {
+		return &cacheStorageDirectory{dirPath: dirPath}, nil
+	}, true)
+	registerCacheStorageType("sharded", func(dirPath string) (CacheStorage, error) {
+		return &cacheStorageDirectory{dirPath: dirPath, sharded: true}, nil
+	}, true)
+	registerCacheStorageType("pack", newCacheStoragePack, false)
+}
+
+// cacheStorageDirectory stores every file of the cache as a file in a directory.
+//
+// If sharded is set, the files are stored in two levels of subdirectories based on the first four characters of their name.
+// Example: ab/cd/abcdef.jpg
+type cacheStorageDirectory struct {
+	dirPath string
+	sharded bool
+}
+
+// path returns the filepath of the file with the given name.
+func (s *cacheStorageDirectory) path(name string) string {
+	if s.sharded && len(name) >= 4 {
+		return filepath.Join(s.dirPath, name[0:2], name[2:4], name)
+	}
+	return filepath.Join(s.dirPath, name)
+}
+
+func (s *cacheStorageDirectory) Open(name string) (io.ReadSeekCloser, CacheFileInfo, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, CacheFileInfo{}, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, CacheFileInfo{}, err
+	}
+
+	return f, CacheFileInfo{Name: name, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *cacheStorageDirectory) Write(name string, data []byte) error {
+	path := s.path(name)
+	if s.sharded {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	// Write into a temporary file first, and replace the actual file afterwards.
+	// The name of the temporary file has an unknown extension, so it will never be listed
+	tmp, err := ioutil.TempFile(filepath.Dir(path), name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails silently once the file has been renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *cacheStorageDirectory) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *cacheStorageDirectory) List() ([]CacheFileInfo, error) {
+	if !s.sharded {
+		return s.listDir(s.dirPath)
+	}
+
+	// Go through all directories of the form ab/cd
+	result := []CacheFileInfo{}
+	firstLevel, err := ioutil.ReadDir(s.dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, first := range firstLevel {
+		if !first.IsDir() || len(first.Name()) != 2 {
+			continue
+		}
+		secondLevel, err := ioutil.ReadDir(filepath.Join(s.dirPath, first.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, second := range secondLevel {
+			if !second.IsDir() || len(second.Name()) != 2 {
+				continue
+			}
+			files, err := s.listDir(filepath.Join(s.dirPath, first.Name(), second.Name()))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, files...)
+		}
+	}
+
+	return result, nil
+}
+
+// listDir returns all cache files inside of the given directory.
+func (s *cacheStorageDirectory) listDir(dirPath string) ([]CacheFileInfo, error) {
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CacheFileInfo, 0, len(files))
+	for _, file := range files {
+		if _, ok := cacheFileHash(file.Name()); ok && !file.IsDir() {
+			result = append(result, CacheFileInfo{Name: file.Name(), Size: file.Size(), ModTime: file.ModTime()})
+		}
+	}
+
+	return result, nil
+}
+
+func (s *cacheStorageDirectory) Close() error {
+	return nil
+}
+
+// cacheStoragePack stores all files of the cache in a single pack file, which is only appended to.
+// The location of every file inside the pack is stored in an index file, which is also only appended to.
+//
+// Every line of the index file is either "put {name} {offset} {size} {modtime}" or "delete {name}".
+// Later lines override earlier ones.
+// Incomplete lines, e.g. after a crash, are ignored.
+//
+// The space of deleted or replaced files is not reclaimed, so this storage can't be used with a size limit.
+// Migrating the cache to another storage type empties and truncates the pack, migrating it back afterwards writes a compact pack.
+type cacheStoragePack struct {
+	sync.RWMutex
+
+	pack, index *os.File
+	packSize    int64
+	files       map[string]cacheStoragePackFile
+}
+
+// cacheStoragePackFile is the location of a file inside the pack.
+type cacheStoragePackFile struct {
+	offset, size int64
+	modTime      time.Time
+}
+
+const (
+	cacheStoragePackFilename  = "cache.pack"
+	cacheStorageIndexFilename = "cache.index"
+)
+
+func newCacheStoragePack(dirPath string) (CacheStorage, error) {
+	pack, err := os.OpenFile(filepath.Join(dirPath, cacheStoragePackFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open pack file: %w", err)
+	}
+	stat, err := pack.Stat()
+	if err != nil {
+		pack.Close()
+		return nil, fmt.Errorf("Couldn't get size of pack file: %w", err)
+	}
+
+	index, err := os.OpenFile(filepath.Join(dirPath, cacheStorageIndexFilename), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		pack.Close()
+		return nil, fmt.Errorf("Couldn't open index file: %w", err)
+	}
+
+	s := &cacheStoragePack{
+		pack:     pack,
+		index:    index,
+		packSize: stat.Size(),
+		files:    map[string]cacheStoragePackFile{},
+	}
+
+	if err := s.readIndex(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Couldn't read index file: %w", err)
+	}
+
+	return s, nil
+}
+
+// readIndex builds the list of files from the index file.
+// An incomplete last line is terminated, so that following lines are not corrupted.
+func (s *cacheStoragePack) readIndex() error {
+	reader := bufio.NewReader(s.index)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				_, err := s.index.WriteString("\n")
+				return err
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 5 && fields[0] == "put":
+			offset, err1 := strconv.ParseInt(fields[2], 10, 64)
+			size, err2 := strconv.ParseInt(fields[3], 10, 64)
+			modTime, err3 := strconv.ParseInt(fields[4], 10, 64)
+			if err1 != nil || err2 != nil || err3 != nil || offset+size > s.packSize {
+				continue
+			}
+			s.files[fields[1]] = cacheStoragePackFile{offset: offset, size: size, modTime: time.Unix(0, modTime)}
+		case len(fields) == 2 && fields[0] == "delete":
+			delete(s.files, fields[1])
+		}
+	}
+}
+
+// appendIndex writes a line with the given fields to the index file.
+func (s *cacheStoragePack) appendIndex(fields ...interface{}) error {
+	_, err := fmt.Fprintln(s.index, fields...)
+	return err
+}
+
+// cacheStoragePackReader is a reader for a single file in the pack.
+type cacheStoragePackReader struct {
+	*io.SectionReader
+}
+
+func (r cacheStoragePackReader) Close() error {
+	return nil
+}
+
+func (s *cacheStoragePack) Open(name string) (io.ReadSeekCloser, CacheFileInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		return nil, CacheFileInfo{}, fmt.Errorf("Couldn't find %q in pack: %w", name, os.ErrNotExist)
+	}
+
+	r := cacheStoragePackReader{io.NewSectionReader(s.pack, file.offset, file.size)}
+	return r, CacheFileInfo{Name: name, Size: file.size, ModTime: file.modTime}, nil
+}
+
+func (s *cacheStoragePack) Write(name string, data []byte) error {
+	if strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("Invalid file name %q", name)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The data has to be on disk before the index references it
+	if _, err := s.pack.WriteAt(data, s.packSize); err != nil {
+		return err
+	}
+	if err := s.pack.Sync(); err != nil {
+		return err
+	}
+
+	file := cacheStoragePackFile{offset: s.packSize, size: int64(len(data)), modTime: time.Now()}
+	s.packSize += file.size
+
+	if err := s.appendIndex("put", name, file.offset, file.size, file.modTime.UnixNano()); err != nil {
+		return err
+	}
+	s.files[name] = file
+
+	return nil
+}
+
+func (s *cacheStoragePack) Remove(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return fmt.Errorf("Couldn't find %q in pack: %w", name, os.ErrNotExist)
+	}
+
+	if err := s.appendIndex("delete", name); err != nil {
+		return err
+	}
+	delete(s.files, name)
+
+	return nil
+}
+
+func (s *cacheStoragePack) List() ([]CacheFileInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make([]CacheFileInfo, 0, len(s.files))
+	for name, file := range s.files {
+		result = append(result, CacheFileInfo{Name: name, Size: file.size, ModTime: file.modTime})
+	}
+
+	return result, nil
+}
+
+// Truncate empties the pack and index file, if all files have been removed from the pack.
+func (s *cacheStoragePack) Truncate() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.files) > 0 {
+		return fmt.Errorf("Pack still contains %d files", len(s.files))
+	}
+
+	if err := s.index.Truncate(0); err != nil {
+		return fmt.Errorf("Couldn't truncate index file: %w", err)
+	}
+	if err := s.pack.Truncate(0); err != nil {
+		return fmt.Errorf("Couldn't truncate pack file: %w", err)
+	}
+	s.packSize = 0
+
+	return nil
+}
+
+func (s *cacheStoragePack) Close() error {
+	errPack, errIndex := s.pack.Close(), s.index.Close()
+	if errPack != nil {
+		return errPack
+	}
+	return errIndex
+}
+
+func init() {
+	registerCommand("migrate", "Move all cache files into another storage type. Use -to to specify the storage type", func(args []string) error {
+		flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+		from := flags.String("from", cache.options.Storage, "Storage type to migrate from")
+		to := flags.String("to", "", "Storage type to migrate to")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+
+		return cache.MigrateStorage(*from, *to)
+	})
+}
+
+// MigrateStorage moves all files of the cache from one storage type into another.
+// Every file is removed from the old storage right after it has been copied, so an interrupted migration can be continued by running it again.
+//
+// The cache itself keeps using its configured storage type.
+func (c *Cache) MigrateStorage(from, to string) error {
+	if from == to {
+		return fmt.Errorf("Source and destination storage type are both %q", from)
+	}
+
+	src := c.storage
+	if from != c.options.Storage {
+		var err error
+		if src, err = NewCacheStorage(from, c.dirPath); err != nil {
+			return err
+		}
+		defer src.Close()
+	}
+
+	dst, err := NewCacheStorage(to, c.dirPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	files, err := src.List()
+	if err != nil {
+		return fmt.Errorf("Couldn't list files in %q storage: %w", from, err)
+	}
+
+	timeStart := time.Now()
+	for i, file := range files {
+		f, _, err := src.Open(file.Name)
+		if err != nil {
+			return fmt.Errorf("Couldn't open %q: %w", file.Name, err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Couldn't read %q: %w", file.Name, err)
+		}
+
+		if err := dst.Write(file.Name, data); err != nil {
+			return fmt.Errorf("Couldn't write %q: %w", file.Name, err)
+		}
+		if err := src.Remove(file.Name); err != nil {
+			return fmt.Errorf("Couldn't remove %q: %w", file.Name, err)
+		}
+
+		if (i+1)%1000 == 0 {
+			log.Infof("Migrated %v of %v files", i+1, len(files))
+		}
+	}
+
+	// Storages that don't reclaim space would otherwise keep the size of all migrated files
+	if truncater, ok := src.(cacheStorageTruncater); ok {
+		if err := truncater.Truncate(); err != nil {
+			return fmt.Errorf("Couldn't truncate %q storage: %w", from, err)
+		}
+	}
+
+	log.Infof("Migrated %v files from %q to %q storage in %v. Set .Cache.Storage to %q in the configuration to use it", len(files), from, to, time.Since(timeStart).Round(time.Second), to)
+
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testImage is an image file that counts how often its content is read.
+type testImage struct {
+	path  string
+	reads int32
+}
+
+func (img *testImage) Hash() string { return "testimage" }
+func (img *testImage) Width() int   { return 64 }
+func (img *testImage) Height() int  { return 48 }
+func (img *testImage) String() string {
+	return fmt.Sprintf("test image %q", img.path)
+}
+
+func (img *testImage) FileContent() (io.ReadCloser, int64, string, error) {
+	atomic.AddInt32(&img.reads, 1)
+	f, err := os.Open(img.path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, "", err
+	}
+	return f, stat.Size(), "image/jpeg", nil
+}
+
+func (img *testImage) CacheEntry() (*CacheEntry, error) {
+	return cache.QueryCacheEntryImage(img)
+}
+
+func TestQueryCacheEntryImageConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.jpg")
+	writeTestJPEG(t, path, 64, 48)
+	options := CacheOptions{RenditionHeights: []int{16, 32}, Formats: []string{"jpeg"}}
+
+	// Generate the entry once to know how often the file is read by a single generation
+	reference := &testImage{path: path}
+	useTestCache(t, options)
+	if _, err := cache.QueryCacheEntryImage(reference); err != nil {
+		t.Fatal(err)
+	}
+
+	img := &testImage{path: path}
+	c := useTestCache(t, options)
+
+	const callers = 50
+	entries := make([]*CacheEntry, callers)
+	errs := make([]error, callers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			entries[i], errs[i] = c.QueryCacheEntryImage(img)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if img.reads != reference.reads {
+		t.Errorf("Image was read %d times, a single generation reads it %d times", img.reads, reference.reads)
+	}
+	for i := range entries {
+		if errs[i] != nil {
+			t.Fatalf("Caller %d got error: %v", i, errs[i])
+		}
+		if entries[i].hash != img.Hash() || entries[i].Width != 64 || entries[i].Height != 48 || !reflect.DeepEqual(entries[i].Renditions, entries[0].Renditions) {
+			t.Errorf("Caller %d got entry %+v, caller 0 got %+v", i, entries[i], entries[0])
+		}
+	}
+}
+
+func TestNewCacheRejectsSizeLimitOfPack(t *testing.T) {
+	if _, err := NewCache(t.TempDir(), CacheOptions{Storage: "pack", MaxSize: 1024 * 1024}); err == nil {
+		t.Error("Pack storage with size limit was accepted, but it never frees the space of evicted files")
+	}
+
+	c, err := NewCache(t.TempDir(), CacheOptions{Storage: "pack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.storage.Close()
+}
+
+func TestMigrateStorageTruncatesPack(t *testing.T) {
+	c := useTestCache(t, CacheOptions{})
+	packPath := filepath.Join(c.dirPath, cacheStoragePackFilename)
+
+	data := []byte("reduced image")
+	if err := c.storage.Write(renditionName("hash", 32, "jpeg"), data); err != nil {
+		t.Fatal(err)
+	}
+
+	// pack -> flat -> pack must not grow the pack
+	for i := 0; i < 3; i++ {
+		if err := c.MigrateStorage(c.options.Storage, "pack"); err != nil {
+			t.Fatal(err)
+		}
+		if stat, err := os.Stat(packPath); err != nil {
+			t.Fatal(err)
+		} else if stat.Size() != int64(len(data)) {
+			t.Fatalf("Pack has %d bytes after %d migrations, want %d", stat.Size(), i+1, len(data))
+		}
+
+		if err := c.MigrateStorage("pack", c.options.Storage); err != nil {
+			t.Fatal(err)
+		}
+		if stat, err := os.Stat(packPath); err != nil {
+			t.Fatal(err)
+		} else if stat.Size() != 0 {
+			t.Errorf("Pack has %d bytes after migrating away from it", stat.Size())
+		}
+	}
+
+	f, _, err := c.storage.Open(renditionName("hash", 32, "jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Got %q, %v after migrating, want %q", got, err, data)
+	}
+}
+
+func TestCacheMemoryReturnsCopies(t *testing.T) {
+	cm := newCacheMemory(1024)
+
+	ce := &CacheEntry{Renditions: []CacheRendition{{Width: 32, Height: 24, Formats: []string{"webp"}}}, Tags: []string{"cat"}}
+	cm.put("hash", ce, 100)
+	ce.Renditions[0].Formats[0], ce.Tags[0] = "changed", "changed"
+
+	got, ok := cm.get("hash")
+	if !ok {
+		t.Fatal("Entry isn't in memory")
+	}
+	if got.Renditions[0].Formats[0] != "webp" || got.Tags[0] != "cat" {
+		t.Errorf("Modifying the stored entry changed the entry in memory: %+v", got)
+	}
+
+	got.Renditions[0].Formats[0], got.Renditions[0].Width = "changed", 0
+	if got, _ := cm.get("hash"); got.Renditions[0].Formats[0] != "webp" || got.Renditions[0].Width != 32 {
+		t.Errorf("Modifying a returned entry changed the entry in memory: %+v", got)
+	}
+}
+
+func TestCacheMemoryLimitsSize(t *testing.T) {
+	cm := newCacheMemory(1000)
+
+	for i := 0; i < 4; i++ {
+		cm.put(fmt.Sprint(i), &CacheEntry{}, 300)
+	}
+	if stats := cm.stats(); stats.Entries != 3 || stats.Size != 900 {
+		t.Errorf("Got %d entries with %d bytes, want 3 entries with 900 bytes", stats.Entries, stats.Size)
+	}
+	if _, ok := cm.get("0"); ok {
+		t.Error("Least recently used entry wasn't dropped")
+	}
+
+	// Replacing an entry accounts for its new size
+	cm.get("1")
+	cm.put("2", &CacheEntry{}, 500)
+	if stats := cm.stats(); stats.Entries != 2 || stats.Size != 800 {
+		t.Errorf("Got %d entries with %d bytes after replacing an entry, want 2 entries with 800 bytes", stats.Entries, stats.Size)
+	}
+	if _, ok := cm.get("1"); !ok {
+		t.Error("Recently used entry was dropped")
+	}
+
+	// Entries larger than the limit are not kept
+	cm.put("huge", &CacheEntry{}, 2000)
+	if stats := cm.stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("Got %d entries with %d bytes after adding a huge entry, want none", stats.Entries, stats.Size)
+	}
+
+	cm.put("4", &CacheEntry{}, 300)
+	cm.remove("4")
+	if stats := cm.stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("Got %d entries with %d bytes after removing the only entry, want none", stats.Entries, stats.Size)
+	}
+}
+
+func TestReducedImageServesSmallestFormat(t *testing.T) {
+	c := useTestCache(t, CacheOptions{})
+	for _, format := range []string{"jpeg", "webp"} {
+		if err := c.storage.Write(renditionName("hash", 32, format), []byte(format)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		sizes map[string]int64
+		want  string
+	}{
+		{map[string]int64{"jpeg": 100, "webp": 50}, "image/webp"},
+		{map[string]int64{"jpeg": 100, "webp": 200}, "image/jpeg"},
+		{map[string]int64{"jpeg": 100, "webp": 100}, "image/jpeg"},
+		{nil, "image/jpeg"}, // Entries written by older versions
+	}
+	for _, test := range tests {
+		ce := &CacheEntry{cache: c, hash: "hash", Renditions: []CacheRendition{{Width: 48, Height: 32, Formats: []string{"webp"}, Sizes: test.sizes}}}
+		r, _, mime, err := ce.ReducedImage(32, []string{"webp"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if mime != test.want {
+			t.Errorf("Got %q for sizes %v, want %q", mime, test.sizes, test.want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeRequests is the number of requests that are currently being served.
+// The cache warmer pauses while this is not zero, see countActiveRequests.
+var activeRequests int32
+
+// uncountedRequestPrefixes contains the paths of requests that don't pause the cache warmer.
+// Downloads can take minutes for large archives or slow connections, and the status of the cache warmer is polled as long as it's running.
+var uncountedRequestPrefixes = []string{"/download/", "/status/"}
+
+// countActiveRequests is a middleware that keeps track of the number of requests that are currently being served.
+// Requests matching uncountedRequestPrefixes are not counted.
+func countActiveRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range uncountedRequestPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		atomic.AddInt32(&activeRequests, 1)
+		defer atomic.AddInt32(&activeRequests, -1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CacheWarmer generates missing cache entries of all images in the background.
+// That way visitors don't have to wait until the cache entries of a new album are generated.
+type CacheWarmer struct {
+	workers int
+
+	mutex  sync.Mutex
+	cancel chan struct{} // Closed to stop the current run
+	status CacheWarmerStatus
+}
+
+// CacheWarmerStatus contains the progress of the cache warmer.
+type CacheWarmerStatus struct {
+	Running bool      `json:"running"` // True while images are being processed
+	Paused  bool      `json:"paused"`  // True while the warmer is waiting for the server to become idle
+	Done    int       `json:"done"`    // Number of images that have been processed
+	Total   int       `json:"total"`   // Number of images found so far
+	Errors  int       `json:"errors"`  // Number of images or containers that couldn't be processed
+	Started time.Time `json:"started"` // Start time of the current or last run
+}
+
+var cacheWarmer *CacheWarmer
+
+// cacheWarmerIdlePoll is the interval in which paused workers check if the server is idle again.
+const cacheWarmerIdlePoll = 500 * time.Millisecond
+
+// cacheWarmerLogInterval is the interval in which the progress is logged.
+const cacheWarmerLogInterval = 30 * time.Second
+
+// NewCacheWarmer returns a cache warmer that uses the given amount of workers.
+// A warmer with zero workers doesn't do anything.
+func NewCacheWarmer(workers int) *CacheWarmer {
+	return &CacheWarmer{
+		workers: workers,
+	}
+}
+
+// Status returns the progress of the current or last run.
+func (cw *CacheWarmer) Status() CacheWarmerStatus {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	return cw.status
+}
+
+// updateStatus modifies the status while holding the lock.
+// Nothing is modified if the run belonging to cancel isn't the current one anymore.
+func (cw *CacheWarmer) updateStatus(cancel chan struct{}, f func(s *CacheWarmerStatus)) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	if cw.cancel == cancel {
+		f(&cw.status)
+	}
+}
+
+// Start stops any previous run, and starts to generate the missing cache entries of all images inside of root.
+func (cw *CacheWarmer) Start(root Element) {
+	if cw.workers <= 0 {
+		return
+	}
+
+	cancel := make(chan struct{})
+
+	cw.mutex.Lock()
+	if cw.cancel != nil {
+		close(cw.cancel)
+	}
+	cw.cancel = cancel
+	cw.status = CacheWarmerStatus{Running: true, Started: time.Now()}
+	cw.mutex.Unlock()
+
+	go cw.run(root, cancel)
+}
+
+// run walks through all images of root and hands them to the workers.
+func (cw *CacheWarmer) run(root Element, cancel chan struct{}) {
+	images := make(chan Image)
+	var wg sync.WaitGroup
+
+	for i := 0; i < cw.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for img := range images {
+				if !cw.waitForIdle(cancel) {
+					continue // Drain the channel
+				}
+
+				// Evicted cache entries are only regenerated when they are needed, otherwise they would be evicted again right away
+				if cache.isEvicted(img.Hash()) {
+					cache.registerImage(img)
+				} else if _, err := img.CacheEntry(); err != nil {
+					log.Warnf("Cache warm-up: Couldn't generate cache entry of %v: %v", img, err)
+					cw.updateStatus(cancel, func(s *CacheWarmerStatus) { s.Errors++ })
+				}
+				cw.updateStatus(cancel, func(s *CacheWarmerStatus) { s.Done++ })
+			}
+		}()
+	}
+
+	// Log progress periodically
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		ticker := time.NewTicker(cacheWarmerLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cancel:
+				return
+			case <-finished:
+				return
+			case <-ticker.C:
+				s := cw.Status()
+				log.Infof("Cache warm-up: Processed %v of %v images so far, %v errors", s.Done, s.Total, s.Errors)
+			}
+		}
+	}()
+
+	log.Infof("Cache warm-up: Started with %v workers", cw.workers)
+
+	seen := map[string]bool{}
+	err := WalkImages(root, func(img Image, err error) error {
+		if err != nil {
+			log.Warnf("Cache warm-up: %v", err)
+			cw.updateStatus(cancel, func(s *CacheWarmerStatus) { s.Errors++ })
+			return nil
+		}
+
+		// Images of combine sources are clones, only process them once
+		hash := img.Hash()
+		if seen[hash] {
+			return nil
+		}
+		seen[hash] = true
+
+		cw.updateStatus(cancel, func(s *CacheWarmerStatus) { s.Total++ })
+
+		select {
+		case images <- img:
+			return nil
+		case <-cancel:
+			return errCacheWarmerCanceled
+		}
+	})
+	close(images)
+	wg.Wait()
+
+	if err == errCacheWarmerCanceled {
+		log.Infof("Cache warm-up: Canceled")
+		return
+	}
+
+	var s CacheWarmerStatus
+	cw.updateStatus(cancel, func(status *CacheWarmerStatus) {
+		status.Running, status.Paused = false, false
+		s = *status
+	})
+
+	log.Infof("Cache warm-up: Finished processing %v images in %v, %v errors", s.Done, time.Since(s.Started).Round(time.Second), s.Errors)
+}
+
+// errCacheWarmerCanceled is used to stop walking the element tree.
+var errCacheWarmerCanceled = errors.New("cache warm-up canceled")
+
+// waitForIdle blocks while the server is serving requests.
+// It returns false if the run got canceled in the meantime.
+func (cw *CacheWarmer) waitForIdle(cancel chan struct{}) bool {
+	for {
+		select {
+		case <-cancel:
+			return false
+		default:
+		}
+
+		if atomic.LoadInt32(&activeRequests) == 0 {
+			cw.updateStatus(cancel, func(s *CacheWarmerStatus) { s.Paused = false })
+			return true
+		}
+
+		cw.updateStatus(cancel, func(s *CacheWarmerStatus) { s.Paused = true })
+
+		select {
+		case <-cancel:
+			return false
+		case <-time.After(cacheWarmerIdlePoll):
+		}
+	}
+}
+
+// ServeHTTP writes the status of the cache warmer as JSON.
+func (cw *CacheWarmer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := json.NewEncoder(w).Encode(cw.Status()); err != nil {
+		log.Errorf("Couldn't encode cache warm-up status: %v", err)
+	}
+}
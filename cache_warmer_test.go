@@ -0,0 +1,49 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountActiveRequests(t *testing.T) {
+	var counted int32
+	handler := countActiveRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counted = atomic.LoadInt32(&activeRequests)
+	}))
+
+	tests := map[string]int32{
+		"/gallery/album":              1,
+		"/cached/0123456789abcdef/32": 1,
+		"/download/album?size=web":    0,
+		"/status/cache-warmup":        0,
+	}
+	for path, want := range tests {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if counted != want {
+			t.Errorf("%d active requests while serving %q, want %d", counted, path, want)
+		}
+	}
+
+	if n := atomic.LoadInt32(&activeRequests); n != 0 {
+		t.Errorf("%d active requests after all requests have been served", n)
+	}
+}
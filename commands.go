@@ -0,0 +1,60 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Command represents a command that can be run from the command line instead of starting the webserver.
+//
+// Example: galago gc -dry-run
+type Command struct {
+	description string
+	run         func(args []string) error // Runs the command with the given arguments
+}
+
+// Commands contains all possible commands.
+var Commands = map[string]Command{}
+
+func registerCommand(name, description string, run func(args []string) error) {
+	Commands[name] = Command{
+		description: description,
+		run:         run,
+	}
+}
+
+// runCommand runs the command with the given name.
+// The sources are loaded before, but no webserver or background work is started.
+func runCommand(name string, args []string) error {
+	command, ok := Commands[name]
+	if !ok {
+		names := []string{}
+		for name, command := range Commands {
+			names = append(names, fmt.Sprintf("%v: %v", name, command.description))
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown command %q. Possible commands:\n%v", name, strings.Join(names, "\n"))
+	}
+
+	reloadSources(conf)
+
+	return command.run(args)
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentHashCache stores the digests of file contents, so that files only need to be read again when they have changed.
+// The digests are indexed by the identity of the file (device and inode, if available), its size and modification time.
+// That way moved and renamed files don't need to be read again, as long as they stay on the same filesystem.
+//
+// The digests are persisted in an append-only text file, every line has the tab separated fields "{file ID} {size} {modtime} {digest}".
+// The file is rewritten without the digests of files that don't exist anymore by Compact.
+type contentHashCache struct {
+	sync.Mutex
+	path    string   // Path of the file the digests are persisted in
+	file    *os.File // Is nil if the digests are not persisted
+	digests map[contentHashKey]string
+	used    map[contentHashKey]bool // Digests that have been used since the last compaction
+}
+
+type contentHashKey struct {
+	fileID  string
+	size    int64
+	modTime int64
+}
+
+// contentHashes contains the digests of all images of sources that use content based hashing.
+var contentHashes = &contentHashCache{digests: map[contentHashKey]string{}, used: map[contentHashKey]bool{}}
+
+// openContentHashCache reads the persisted digests from the given file, and appends any new digests to it.
+func openContentHashCache(path string) (*contentHashCache, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	chc := &contentHashCache{path: path, file: file, digests: map[contentHashKey]string{}, used: map[contentHashKey]bool{}}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// Terminate any incomplete last line
+			if line != "" {
+				if _, err := file.WriteString("\n"); err != nil {
+					file.Close()
+					return nil, err
+				}
+			}
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(fields[1], 10, 64)
+		modTime, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		chc.digests[contentHashKey{fileID: fields[0], size: size, modTime: modTime}] = fields[3]
+	}
+
+	return chc, nil
+}
+
+// Digest returns the SHA-256 digest of the content of the file at path.
+// The file is only read if there is no digest of it yet.
+func (chc *contentHashCache) Digest(path string, info os.FileInfo) (string, error) {
+	key := contentHashKey{fileID: fileID(path, info), size: info.Size(), modTime: info.ModTime().UnixNano()}
+
+	chc.Lock()
+	digest, ok := chc.digests[key]
+	if ok {
+		chc.used[key] = true
+	}
+	chc.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Couldn't read %q: %w", path, err)
+	}
+	digest = fmt.Sprintf("%x", h.Sum(nil))
+
+	chc.Lock()
+	defer chc.Unlock()
+
+	chc.digests[key] = digest
+	chc.used[key] = true
+	if chc.file != nil && !strings.ContainsAny(key.fileID, "\t\r\n") {
+		if _, err := fmt.Fprintf(chc.file, "%s\t%d\t%d\t%s\n", key.fileID, key.size, key.modTime, digest); err != nil {
+			log.Warnf("Couldn't store content digest of %q: %v", path, err)
+		}
+	}
+
+	return digest, nil
+}
+
+// Compact removes all digests that haven't been used since the last compaction, and rewrites the file without them.
+//
+// This must only be called right after the digests of all existing files have been requested, e.g. by the garbage collection.
+// Otherwise digests of existing files are removed, and the files have to be read again.
+func (chc *contentHashCache) Compact() error {
+	chc.Lock()
+	defer chc.Unlock()
+
+	for key := range chc.digests {
+		if !chc.used[key] {
+			delete(chc.digests, key)
+		}
+	}
+	chc.used = map[contentHashKey]bool{}
+
+	if chc.file == nil {
+		return nil
+	}
+
+	// Write the remaining digests into a new file, and replace the old file with it
+	tempPath := chc.path + ".tmp"
+	temp, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(temp)
+	for key, digest := range chc.digests {
+		if !strings.ContainsAny(key.fileID, "\t\r\n") {
+			fmt.Fprintf(writer, "%s\t%d\t%d\t%s\n", key.fileID, key.size, key.modTime, digest)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("Couldn't write %q: %w", tempPath, err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Couldn't write %q: %w", tempPath, err)
+	}
+
+	// The old file has to be closed before it can be replaced on some systems
+	chc.file.Close()
+	errRename := os.Rename(tempPath, chc.path)
+	if errRename != nil {
+		os.Remove(tempPath)
+	}
+
+	if chc.file, err = os.OpenFile(chc.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		chc.file = nil
+		return fmt.Errorf("Couldn't reopen %q, content digests will not be persisted anymore: %w", chc.path, err)
+	}
+	if errRename != nil {
+		return fmt.Errorf("Couldn't replace %q: %w", chc.path, errRename)
+	}
+
+	return nil
+}
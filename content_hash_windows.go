@@ -0,0 +1,31 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// fileID returns an identifier of the file.
+// There is no cheap way to get a file's index on Windows, so the path is used instead.
+func fileID(path string, info os.FileInfo) string {
+	return path
+}
@@ -0,0 +1,323 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// downloadSizes contains the sizes that images can be downloaded in, and the height of the reduced version that is used for them.
+// A height of 0 means that the original image file is used.
+var downloadSizes = map[string]int{
+	"original": 0,
+	"large":    2160,
+	"web":      1080,
+}
+
+// downloadFile is a file that can be downloaded, either on its own or as part of an archive.
+type downloadFile struct {
+	name    string // File name, or path inside of an archive
+	size    int64
+	modTime time.Time // Modification time, may be zero if it's not known
+	mime    string
+	etag    string // Entity tag that identifies the content of the file
+}
+
+// errDownloadNotAllowed is returned when an image can't be downloaded in the requested size because of its access policy.
+var errDownloadNotAllowed = errors.New("download not allowed")
+
+// newDownloadFile returns the file of the image in the given size, see downloadSizes, and its opened content.
+// The content has to be closed by the caller.
+//
+// Reduced versions are taken from the cache, and are always JPEG files.
+// The name of reduced versions gets the size appended, e.g. "cat.jpg" becomes "cat-web.jpg".
+func newDownloadFile(img Image, name, size string) (downloadFile, io.ReadCloser, error) {
+	height, ok := downloadSizes[size]
+	if !ok {
+		return downloadFile{}, nil, fmt.Errorf("Unknown download size %q", size)
+	}
+
+	if height > 0 {
+		ce, err := cache.QueryCacheEntryImage(img)
+		if err != nil {
+			return downloadFile{}, nil, fmt.Errorf("Couldn't get cache entry of %v: %w", img, err)
+		}
+
+		// Oversized images only have a placeholder, so the original is used instead.
+		// That's not possible if the original must not be accessed
+		if e, ok := img.(Element); ok && ce.Oversized && EffectiveAccessPolicy(e).NoOriginals {
+			return downloadFile{}, nil, fmt.Errorf("%v is too large to be reduced, and its original can't be accessed: %w", img, errDownloadNotAllowed)
+		}
+		if !ce.Oversized {
+			r, info, mime, err := ce.ReducedImage(height, nil)
+			if err != nil {
+				return downloadFile{}, nil, fmt.Errorf("Couldn't open reduced image of %v: %w", img, err)
+			}
+
+			return downloadFile{
+				name:    strings.TrimSuffix(name, path.Ext(name)) + "-" + size + "." + cacheFormats["jpeg"].extension,
+				size:    info.Size,
+				modTime: info.ModTime,
+				mime:    mime,
+				etag:    info.Name,
+			}, r, nil
+		}
+	}
+
+	// Watermarked originals are re-encoded, so they don't contain any metadata anyway
+	if wm := imageWatermark(img); wm != nil && wm.originals {
+		r, info, err := cache.WatermarkedOriginal(img, wm)
+		if err != nil {
+			return downloadFile{}, nil, fmt.Errorf("Couldn't get watermarked original of %v: %w", img, err)
+		}
+
+		return downloadFile{
+			name:    strings.TrimSuffix(name, path.Ext(name)) + "." + cacheFormats["jpeg"].extension,
+			size:    info.Size,
+			modTime: info.ModTime,
+			mime:    cacheFormats["jpeg"].mime,
+			etag:    info.Name,
+		}, r, nil
+	}
+
+	r, fileSize, mime, err := img.FileContent()
+	if err != nil {
+		return downloadFile{}, nil, fmt.Errorf("Couldn't open original image of %v: %w", img, err)
+	}
+
+	// Metadata is removed from the original file according to the policy of its source
+	etag := img.Hash()
+	if policy := imageMetadataPolicy(img); !policy.IsEmpty() {
+		stripped, strippedSize, err := StripMetadata(r, fileSize, mime, policy)
+		if err != nil {
+			r.Close()
+			return downloadFile{}, nil, fmt.Errorf("Couldn't remove metadata from %v: %w", img, err)
+		}
+		r, fileSize = stripped, strippedSize
+		etag += "-" + policy.String()
+	}
+
+	return downloadFile{
+		name:    name,
+		size:    fileSize,
+		modTime: imageModTime(img),
+		mime:    mime,
+		etag:    etag,
+	}, r, nil
+}
+
+// unprocessedDownloadFile returns the file of the image in the given size, see downloadSizes, without opening it.
+// This is only possible for files that are sent as they are: Reduced versions that are already in the cache, and originals that have neither metadata removed nor a watermark.
+// The boolean is false for any other file.
+func unprocessedDownloadFile(img Image, name, size string) (downloadFile, bool) {
+	height, ok := downloadSizes[size]
+	if !ok {
+		return downloadFile{}, false
+	}
+
+	if height > 0 {
+		ce, ok := cache.queryValidCacheEntry(img.Hash())
+		if !ok || ce.Oversized {
+			return downloadFile{}, false
+		}
+		r, info, mime, err := ce.ReducedImage(height, nil)
+		if err != nil {
+			return downloadFile{}, false
+		}
+		r.Close()
+
+		return downloadFile{
+			name:    strings.TrimSuffix(name, path.Ext(name)) + "-" + size + "." + cacheFormats["jpeg"].extension,
+			size:    info.Size,
+			modTime: info.ModTime,
+			mime:    mime,
+			etag:    info.Name,
+		}, true
+	}
+
+	if wm := imageWatermark(img); (wm != nil && wm.originals) || !imageMetadataPolicy(img).IsEmpty() {
+		return downloadFile{}, false
+	}
+
+	r, fileSize, mime, err := img.FileContent()
+	if err != nil {
+		return downloadFile{}, false
+	}
+	r.Close()
+
+	return downloadFile{
+		name:    name,
+		size:    fileSize,
+		modTime: imageModTime(img),
+		mime:    mime,
+		etag:    img.Hash(),
+	}, true
+}
+
+// downloadEntry is an image that is added to an archive.
+// Its file is only prepared when it's written, so that the archive can be sent without processing all images first.
+type downloadEntry struct {
+	img  Image
+	name string // Path inside of the archive, the file name of reduced versions is changed by newDownloadFile
+}
+
+// collectDownloadEntries returns all images contained in element, inside of the given directory.
+// If recursive is set, all nested containers are added as subdirectories.
+// Hidden elements and tag sources are skipped, as the latter only contain images that can be found elsewhere.
+// Images and containers for which include returns false are skipped, too.
+func collectDownloadEntries(element Element, dir string, recursive bool, include func(Element) bool) ([]downloadEntry, error) {
+	children, err := element.Children()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get children of %v: %w", element, err)
+	}
+
+	entries := []downloadEntry{}
+	for _, child := range FilterNonHidden(children) {
+		if !include(child) {
+			continue
+		}
+
+		if img, ok := child.(Image); ok {
+			entries = append(entries, downloadEntry{img: img, name: dir + child.URLName()})
+		}
+
+		if _, ok := child.(*SourceTags); ok {
+			continue
+		}
+
+		if recursive && child.IsContainer() {
+			childEntries, err := collectDownloadEntries(child, dir+child.URLName()+"/", recursive, include)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, childEntries...)
+		}
+	}
+
+	return entries, nil
+}
+
+// zipHeader returns the header of the file inside of an archive.
+// Images are stored without compression, as they are already compressed.
+func (f downloadFile) zipHeader() *zip.FileHeader {
+	return &zip.FileHeader{Name: f.name, Method: zip.Store, Modified: f.modTime}
+}
+
+// zipSize returns the exact size of the archive that writeZip generates for the given entries in the given size.
+// The files are also returned, writeZip has to be called with them to ensure that the archive has exactly this size.
+//
+// This is only possible if none of the files has to be processed, see unprocessedDownloadFile.
+// As files are stored without compression, the size of the archive is the sum of the file sizes plus the size of an archive with empty files.
+// This doesn't hold for archives that need ZIP64 extensions.
+// In both cases the boolean is false.
+func zipSize(entries []downloadEntry, size string) (int64, []downloadFile, bool) {
+	files := make([]downloadFile, 0, len(entries))
+	for _, entry := range entries {
+		file, ok := unprocessedDownloadFile(entry.img, entry.name, size)
+		if !ok {
+			return 0, nil, false
+		}
+		files = append(files, file)
+	}
+
+	cw := &countWriter{w: ioutil.Discard}
+	zw := zip.NewWriter(cw)
+	var sum int64
+	for _, file := range files {
+		if _, err := zw.CreateHeader(file.zipHeader()); err != nil {
+			return 0, nil, false
+		}
+		sum += file.size
+	}
+	if err := zw.Close(); err != nil {
+		return 0, nil, false
+	}
+
+	archiveSize := cw.count + sum
+	if archiveSize >= 0xFFFFFFFF || len(files) >= 0xFFFF {
+		return 0, nil, false
+	}
+
+	return archiveSize, files, true
+}
+
+// writeZip writes an archive containing the images of the given entries in the given size.
+// The files are prepared one after another while the archive is written, and are closed once they are written.
+// Images that can't be downloaded in the given size because of their access policy are left out.
+//
+// If the size of the archive has already been sent, the files returned by zipSize have to be given.
+// An error is returned if any file differs from them, as the archive would have a different size otherwise.
+func writeZip(w io.Writer, entries []downloadEntry, size string, expected []downloadFile) error {
+	zw := zip.NewWriter(w)
+
+	for i, entry := range entries {
+		file, r, err := newDownloadFile(entry.img, entry.name, size)
+		if errors.Is(err, errDownloadNotAllowed) && expected == nil {
+			log.Debugf("Leaving %v out of archive: %v", entry.img, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if expected != nil && (file.name != expected[i].name || file.size != expected[i].size || !file.modTime.Equal(expected[i].modTime)) {
+			r.Close()
+			return fmt.Errorf("File %q has changed while it was being archived", file.name)
+		}
+
+		err = file.writeZip(zw, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// writeZip writes the file with the given content into the archive.
+func (f downloadFile) writeZip(zw *zip.Writer, r io.Reader) error {
+	w, err := zw.CreateHeader(f.zipHeader())
+	if err != nil {
+		return fmt.Errorf("Couldn't create archive entry %q: %w", f.name, err)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("Couldn't write archive entry %q: %w", f.name, err)
+	}
+
+	return nil
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
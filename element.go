@@ -156,6 +156,16 @@ func FilterNonHidden(ee []Element) []Element {
 	return result
 }
 
+// IsHiddenPath returns whether the element or any of its parents is hidden.
+func IsHiddenPath(e Element) bool {
+	for ; e != nil; e = e.Parent() {
+		if e.IsHidden() {
+			return true
+		}
+	}
+	return false
+}
+
 // GetPreviewImages tries to return up to n images that are contained inside the given element e.
 // This will iterate over all children until the needed amount of images is found.
 // Hidden children (images or containers) will be ignored, though.
@@ -168,6 +178,16 @@ func GetPreviewImages(e Element, n int) ([]Image, error) {
 	}
 	children = FilterNonHidden(children)
 
+	// Skip elements that need a password the given element doesn't need.
+	// Otherwise previews would reveal their content
+	unprotected := []Element{}
+	for _, child := range children {
+		if !hasOwnProtection(e, child) {
+			unprotected = append(unprotected, child)
+		}
+	}
+	children = unprotected
+
 	// Fill result with direct children image elements
 	images := FilterImages(children)
 	for _, image := range images {
@@ -222,3 +242,36 @@ func GetHomeElement(e Element) Element {
 
 	return e
 }
+
+// WalkImages calls f for every image that is contained inside the given element e, recursively.
+// Tag sources are skipped, as they only contain images that can be found elsewhere.
+// Images that are contained in several places, e.g. because of combine sources, are passed to f multiple times.
+//
+// Any error returned by f will stop the walk and will be returned.
+// Errors while retrieving children are passed to f with a nil image, the walk continues if f returns nil.
+func WalkImages(e Element, f func(img Image, err error) error) error {
+	children, err := e.Children()
+	if err != nil {
+		return f(nil, fmt.Errorf("Couldn't get children of %v: %w", e, err))
+	}
+
+	for _, child := range children {
+		if _, ok := child.(*SourceTags); ok {
+			continue
+		}
+
+		if img, ok := child.(Image); ok {
+			if err := f(img, nil); err != nil {
+				return err
+			}
+		}
+
+		if child.IsContainer() {
+			if err := WalkImages(child, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
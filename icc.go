@@ -0,0 +1,456 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// ReadICCProfile returns the raw ICC profile that is embedded in the given image file, or nil if there is none.
+// Only JPEG (APP2 segments) and PNG (iCCP chunk) files are supported, any other file type will return nil.
+func ReadICCProfile(r io.Reader, mime string) ([]byte, error) {
+	switch mime {
+	case "image/jpeg":
+		return readJPEGICCProfile(r)
+	case "image/png":
+		return readPNGICCProfile(r)
+	}
+
+	return nil, nil
+}
+
+// readImageICCProfile returns the raw ICC profile that is embedded in the file of the given image element, or nil if there is none.
+func readImageICCProfile(img Image) ([]byte, error) {
+	file, _, mime, err := img.FileContent()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadICCProfile(file, mime)
+}
+
+// readJPEGICCProfile reads and reassembles the ICC profile chunks from the APP2 segments of a JPEG file.
+func readJPEGICCProfile(r io.Reader) ([]byte, error) {
+	header := []byte("ICC_PROFILE\x00")
+	chunks := map[byte][]byte{}
+
+	err := walkJPEGSegments(r, []byte{jpegMarkerAPP2}, func(marker byte, payload []byte) error {
+		if !bytes.HasPrefix(payload, header) || len(payload) < len(header)+2 {
+			return nil
+		}
+		seqNo := payload[len(header)] // Starts at 1
+		chunks[seqNo] = payload[len(header)+2:]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	seqNos := []int{}
+	for seqNo := range chunks {
+		seqNos = append(seqNos, int(seqNo))
+	}
+	sort.Ints(seqNos)
+
+	var profile []byte
+	for _, seqNo := range seqNos {
+		profile = append(profile, chunks[byte(seqNo)]...)
+	}
+
+	return profile, nil
+}
+
+// readPNGICCProfile reads and decompresses the ICC profile from the iCCP chunk of a PNG file.
+func readPNGICCProfile(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(br, signature); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(signature, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, fmt.Errorf("missing PNG signature")
+	}
+
+	for {
+		var chunkHeader struct {
+			Length uint32
+			Type   [4]byte
+		}
+		if err := binary.Read(br, binary.BigEndian, &chunkHeader); err != nil {
+			return nil, err
+		}
+
+		switch string(chunkHeader.Type[:]) {
+		case "IDAT", "IEND": // The iCCP chunk has to be placed before any image data
+			return nil, nil
+
+		case "iCCP":
+			data := make([]byte, chunkHeader.Length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, err
+			}
+
+			// Skip the profile name and the compression method
+			nameEnd := bytes.IndexByte(data, 0)
+			if nameEnd < 0 || nameEnd+2 > len(data) {
+				return nil, fmt.Errorf("malformed iCCP chunk")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[nameEnd+2:]))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+
+			return ioutil.ReadAll(zr)
+		}
+
+		// Skip chunk data and CRC
+		if _, err := br.Discard(int(chunkHeader.Length) + 4); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// iccCurve is a tone reproduction curve of an ICC profile.
+// It maps encoded values in the range [0, 1] to linear values.
+type iccCurve func(float64) float64
+
+// ICCProfile contains the parsed colorimetry of a matrix/TRC based RGB ICC profile.
+// This covers most RGB working spaces like Adobe RGB, Display P3 or ProPhoto RGB.
+type ICCProfile struct {
+	matrix [3][3]float64   // Matrix from linear RGB to the D50 XYZ profile connection space. Columns are the red, green and blue colorants
+	curves [3]iccCurve     // Tone reproduction curves of the red, green and blue channel
+	lut    [3][256]float32 // Lookup table from 8 bit encoded values to linear values
+}
+
+// xyzD50ToLinearSRGB converts D50 adapted XYZ values into linear sRGB values.
+// This is the inverse of the sRGB colorant matrix with Bradford chromatic adaptation, like it is used in the sRGB ICC profiles.
+var xyzD50ToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbColorants contains the D50 adapted colorants of sRGB, used to detect profiles that are already sRGB.
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// ErrICCProfileUnsupported is returned when an ICC profile can't be used for conversion.
+// This is the case for profiles that are not based on a matrix and tone reproduction curves, like LUT based or CMYK profiles.
+var ErrICCProfileUnsupported = fmt.Errorf("ICC profile is not a supported matrix/TRC RGB profile")
+
+// iccProfileColorSpace returns the signature of the color space of a raw ICC profile, e.g. "RGB ", "CMYK" or "GRAY".
+// An empty string is returned if the profile is too short.
+func iccProfileColorSpace(data []byte) string {
+	if len(data) < 20 {
+		return ""
+	}
+	return string(data[16:20])
+}
+
+// ParseICCProfile parses a raw ICC profile.
+// ErrICCProfileUnsupported is returned if the profile is valid, but can't be used for conversion.
+func ParseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < 132 {
+		return nil, fmt.Errorf("ICC profile too short")
+	}
+	if !bytes.Equal(data[36:40], []byte("acsp")) {
+		return nil, fmt.Errorf("missing ICC profile signature")
+	}
+	if !bytes.Equal(data[16:20], []byte("RGB ")) || !bytes.Equal(data[20:24], []byte("XYZ ")) {
+		return nil, ErrICCProfileUnsupported
+	}
+
+	// Read the tag table
+	tags := map[string][]byte{}
+	tagCount := int(binary.BigEndian.Uint32(data[128:132]))
+	for i := 0; i < tagCount; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, fmt.Errorf("ICC tag table exceeds the profile")
+		}
+		signature := string(data[entry : entry+4])
+		offset := int(binary.BigEndian.Uint32(data[entry+4 : entry+8]))
+		size := int(binary.BigEndian.Uint32(data[entry+8 : entry+12]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, fmt.Errorf("ICC tag %q exceeds the profile", signature)
+		}
+		tags[signature] = data[offset : offset+size]
+	}
+
+	p := &ICCProfile{}
+
+	for i, signature := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag, ok := tags[signature]
+		if !ok {
+			return nil, ErrICCProfileUnsupported
+		}
+		if len(tag) < 20 || !bytes.Equal(tag[:4], []byte("XYZ ")) {
+			return nil, fmt.Errorf("malformed ICC tag %q", signature)
+		}
+		for j := 0; j < 3; j++ {
+			p.matrix[j][i] = iccS15Fixed16(tag[8+j*4:])
+		}
+	}
+
+	for i, signature := range []string{"rTRC", "gTRC", "bTRC"} {
+		tag, ok := tags[signature]
+		if !ok {
+			return nil, ErrICCProfileUnsupported
+		}
+		curve, err := parseICCCurve(tag)
+		if err != nil {
+			return nil, fmt.Errorf("malformed ICC tag %q: %w", signature, err)
+		}
+		p.curves[i] = curve
+		for v := range p.lut[i] {
+			p.lut[i][v] = float32(curve(float64(v) / 255))
+		}
+	}
+
+	return p, nil
+}
+
+// iccS15Fixed16 decodes a signed 15.16 fixed point number.
+func iccS15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICCCurve parses a curv or para tag.
+func parseICCCurve(tag []byte) (iccCurve, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("curve too short")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:12]))
+		if len(tag) < 12+count*2 {
+			return nil, fmt.Errorf("curve table exceeds the tag")
+		}
+		switch count {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:14])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return func(v float64) float64 {
+			pos := v * float64(count-1)
+			i := int(pos)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			if i < 0 {
+				return table[0]
+			}
+			frac := pos - float64(i)
+			return table[i]*(1-frac) + table[i+1]*frac
+		}, nil
+
+	case "para":
+		functionType := binary.BigEndian.Uint16(tag[8:10])
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if int(functionType) >= len(paramCounts) {
+			return nil, fmt.Errorf("unknown parametric curve type %d", functionType)
+		}
+		if len(tag) < 12+paramCounts[functionType]*4 {
+			return nil, fmt.Errorf("parametric curve exceeds the tag")
+		}
+		var params [7]float64
+		for i := 0; i < paramCounts[functionType]; i++ {
+			params[i] = iccS15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+		switch functionType {
+		case 0:
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		case 1:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return math.Pow(a*v+b, g)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return math.Pow(a*v+b, g) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(v float64) float64 {
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			}, nil
+		default:
+			return func(v float64) float64 {
+				if v >= d {
+					return math.Pow(a*v+b, g) + e
+				}
+				return c*v + f
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown curve type %q", tag[:4])
+}
+
+// IsSRGB returns whether the profile is close enough to sRGB that a conversion isn't necessary.
+func (p *ICCProfile) IsSRGB() bool {
+	for i := range p.matrix {
+		for j := range p.matrix[i] {
+			if math.Abs(p.matrix[i][j]-srgbColorants[i][j]) > 0.002 {
+				return false
+			}
+		}
+	}
+
+	for _, curve := range p.curves {
+		for _, v := range []float64{0.1, 0.25, 0.5, 0.75, 0.9} {
+			if math.Abs(curve(v)-srgbDecode(v)) > 0.005 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// srgbDecode converts an encoded sRGB value into a linear value.
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// srgbEncode converts a linear value into an encoded sRGB value.
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbEncodeLUT maps linear values in the range [0, 1] with a resolution of 4096 steps to 8 bit sRGB values.
+var srgbEncodeLUT = func() (lut [4096]uint8) {
+	for i := range lut {
+		lut[i] = uint8(math.Round(srgbEncode(float64(i)/float64(len(lut)-1)) * 255))
+	}
+	return
+}()
+
+// ConvertToSRGB converts the pixels of the given image from the color space of the profile to sRGB.
+// The result is always an 8 bit per channel image.
+func (p *ICCProfile) ConvertToSRGB(img image.Image) *image.NRGBA {
+	// Combined matrix from the profile's linear RGB to linear sRGB
+	var m [3][3]float32
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			var sum float64
+			for k := 0; k < 3; k++ {
+				sum += xyzD50ToLinearSRGB[i][k] * p.matrix[k][j]
+			}
+			m[i][j] = float32(sum)
+		}
+	}
+
+	encode := func(v float32) uint8 {
+		switch {
+		case v <= 0:
+			return 0
+		case v >= 1:
+			return 255
+		}
+		return srgbEncodeLUT[int(v*float32(len(srgbEncodeLUT)-1)+0.5)]
+	}
+
+	bounds := img.Bounds()
+	result := image.NewNRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			r, g, b := p.lut[0][c.R], p.lut[1][c.G], p.lut[2][c.B]
+			i := result.PixOffset(x, y)
+			result.Pix[i+0] = encode(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+			result.Pix[i+1] = encode(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+			result.Pix[i+2] = encode(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+			result.Pix[i+3] = c.A
+		}
+	}
+
+	return result
+}
+
+// jpegEmbedICCProfile inserts the given ICC profile as APP2 segments into an encoded JPEG file.
+// This is used for profiles that can't be converted to sRGB, so that browsers can still do the color management.
+func jpegEmbedICCProfile(jpegData, profile []byte) ([]byte, error) {
+	if len(jpegData) < 2 || jpegData[0] != 0xFF || jpegData[1] != jpegMarkerSOI {
+		return nil, fmt.Errorf("missing JPEG SOI marker")
+	}
+
+	const maxChunkSize = 65535 - 2 - 14 // Max segment size minus length field minus header
+	chunkCount := (len(profile) + maxChunkSize - 1) / maxChunkSize
+	if chunkCount > 255 {
+		return nil, fmt.Errorf("ICC profile too large to be embedded")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(jpegData)+len(profile)+chunkCount*18))
+	buf.Write(jpegData[:2])
+	for i := 0; i < chunkCount; i++ {
+		chunk := profile[i*maxChunkSize:]
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		buf.Write([]byte{0xFF, jpegMarkerAPP2})
+		binary.Write(buf, binary.BigEndian, uint16(2+14+len(chunk)))
+		buf.WriteString("ICC_PROFILE\x00")
+		buf.Write([]byte{byte(i + 1), byte(chunkCount)})
+		buf.Write(chunk)
+	}
+	buf.Write(jpegData[2:])
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// testICCProfile returns an ICC profile with the given color space and profile connection space.
+// If colorants is not nil, the profile contains the tags of a matrix/TRC profile with the given colorants, and the given curve for all channels.
+func testICCProfile(colorSpace, pcs string, colorants *[3][3]float64, curve []byte) []byte {
+	tags := map[string][]byte{}
+	if colorants != nil {
+		for i, signature := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+			tag := []byte("XYZ \x00\x00\x00\x00")
+			for j := 0; j < 3; j++ {
+				tag = append(tag, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(tag[len(tag)-4:], uint32(int32(math.Round(colorants[j][i]*65536))))
+			}
+			tags[signature] = tag
+		}
+		for _, signature := range []string{"rTRC", "gTRC", "bTRC"} {
+			tags[signature] = curve
+		}
+	}
+
+	data := make([]byte, 132+len(tags)*12)
+	copy(data[16:20], colorSpace)
+	copy(data[20:24], pcs)
+	copy(data[36:40], "acsp")
+	binary.BigEndian.PutUint32(data[128:], uint32(len(tags)))
+	i := 0
+	for _, signature := range []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"} {
+		tag, ok := tags[signature]
+		if !ok {
+			continue
+		}
+		entry := data[132+i*12:]
+		copy(entry, signature)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag)))
+		data = append(data, tag...)
+		i++
+	}
+	binary.BigEndian.PutUint32(data[0:], uint32(len(data)))
+
+	return data
+}
+
+// testICCParametricCurve returns a para tag with the given function type and parameters.
+func testICCParametricCurve(functionType uint16, params ...float64) []byte {
+	tag := []byte("para\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tag[8:], functionType)
+	for _, param := range params {
+		tag = append(tag, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(tag[len(tag)-4:], uint32(int32(math.Round(param*65536))))
+	}
+	return tag
+}
+
+var (
+	testICCSRGBCurve  = testICCParametricCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+	testICCGammaCurve = []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33") // Gamma 2.2
+
+	// D50 adapted colorants of Adobe RGB (1998)
+	testICCAdobeRGBColorants = [3][3]float64{
+		{0.6097, 0.2053, 0.1492},
+		{0.3111, 0.6257, 0.0632},
+		{0.0195, 0.0609, 0.7446},
+	}
+)
+
+func TestParseICCProfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		unsupported bool // ErrICCProfileUnsupported is expected
+		invalid     bool // Any other error is expected
+		srgb        bool
+	}{
+		{"sRGB", testICCProfile("RGB ", "XYZ ", &srgbColorants, testICCSRGBCurve), false, false, true},
+		{"Adobe RGB", testICCProfile("RGB ", "XYZ ", &testICCAdobeRGBColorants, testICCGammaCurve), false, false, false},
+		{"sRGB colorants with gamma curve", testICCProfile("RGB ", "XYZ ", &srgbColorants, testICCGammaCurve), false, false, false},
+		{"LUT based RGB", testICCProfile("RGB ", "Lab ", nil, nil), true, false, false},
+		{"RGB without tags", testICCProfile("RGB ", "XYZ ", nil, nil), true, false, false},
+		{"CMYK", testICCProfile("CMYK", "Lab ", nil, nil), true, false, false},
+		{"Gray", testICCProfile("GRAY", "XYZ ", nil, nil), true, false, false},
+		{"Too short", []byte("RGB "), false, true, false},
+		{"Missing signature", make([]byte, 200), false, true, false},
+		{"Truncated tag", testICCProfile("RGB ", "XYZ ", &srgbColorants, testICCSRGBCurve)[:300], false, true, false},
+	}
+
+	for _, test := range tests {
+		p, err := ParseICCProfile(test.data)
+		switch {
+		case test.unsupported:
+			if !errors.Is(err, ErrICCProfileUnsupported) {
+				t.Errorf("%s: Got error %v, want %v", test.name, err, ErrICCProfileUnsupported)
+			}
+		case test.invalid:
+			if err == nil || errors.Is(err, ErrICCProfileUnsupported) {
+				t.Errorf("%s: Got error %v, want a parsing error", test.name, err)
+			}
+		case err != nil:
+			t.Errorf("%s: Couldn't parse profile: %v", test.name, err)
+		case p.IsSRGB() != test.srgb:
+			t.Errorf("%s: IsSRGB returned %v, want %v", test.name, p.IsSRGB(), test.srgb)
+		}
+	}
+}
+
+func TestICCProfileConvertToSRGB(t *testing.T) {
+	p, err := ParseICCProfile(testICCProfile("RGB ", "XYZ ", &testICCAdobeRGBColorants, testICCGammaCurve))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 128})
+	img.SetNRGBA(2, 0, color.NRGBA{60, 160, 60, 255})
+	converted := p.ConvertToSRGB(img)
+
+	// White and black stay the same, and alpha is kept
+	if c := converted.NRGBAAt(0, 0); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("White was converted to %v", c)
+	}
+	if c := converted.NRGBAAt(1, 0); c != (color.NRGBA{0, 0, 0, 128}) {
+		t.Errorf("Transparent black was converted to %v", c)
+	}
+
+	// Green in Adobe RGB is more saturated than the same values in sRGB
+	if c := converted.NRGBAAt(2, 0); c.G <= 160 || c.R >= 60 {
+		t.Errorf("Adobe RGB green %v was converted to %v, expected a more saturated green", img.NRGBAAt(2, 0), c)
+	}
+}
+
+func TestProfileColorConversion(t *testing.T) {
+	pixel := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	pixel.SetNRGBA(0, 0, color.NRGBA{60, 160, 60, 255})
+
+	lutRGB := testICCProfile("RGB ", "Lab ", nil, nil)
+
+	tests := []struct {
+		name    string
+		profile []byte
+		convert bool   // Whether the colors are changed
+		embed   []byte // Profile that is embedded into the reduced images
+		err     bool   // Whether the profile is ignored with an error
+	}{
+		{"No profile", nil, false, nil, false},
+		{"sRGB", testICCProfile("RGB ", "XYZ ", &srgbColorants, testICCSRGBCurve), false, nil, false},
+		{"Adobe RGB", testICCProfile("RGB ", "XYZ ", &testICCAdobeRGBColorants, testICCGammaCurve), true, nil, false},
+		{"LUT based RGB", lutRGB, false, lutRGB, false},
+		{"CMYK", testICCProfile("CMYK", "Lab ", nil, nil), false, nil, true},
+		{"Gray", testICCProfile("GRAY", "XYZ ", nil, nil), false, nil, true},
+		{"Invalid", make([]byte, 200), false, nil, true},
+	}
+
+	for _, test := range tests {
+		convertColors, embed, err := profileColorConversion(test.profile)
+		if (err != nil) != test.err {
+			t.Errorf("%s: Got error %v, want error: %v", test.name, err, test.err)
+		}
+		if !bytes.Equal(embed, test.embed) {
+			t.Errorf("%s: Got %d bytes of profile to embed, want %d bytes", test.name, len(embed), len(test.embed))
+		}
+		converted := color.NRGBAModel.Convert(convertColors(pixel).At(0, 0))
+		if changed := converted != pixel.At(0, 0); changed != test.convert {
+			t.Errorf("%s: Pixel %v was converted to %v", test.name, pixel.At(0, 0), converted)
+		}
+	}
+}
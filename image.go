@@ -19,6 +19,7 @@ package main
 
 import (
 	"io"
+	"time"
 )
 
 // Image references an image file stored in a source.
@@ -42,3 +43,15 @@ func FilterImages(ee []Element) []Image {
 	}
 	return result
 }
+
+// ImageSidecar is implemented by images that can have an XMP sidecar file next to them.
+// Metadata from the sidecar file takes precedence over the metadata embedded in the image file.
+type ImageSidecar interface {
+	SidecarContent() (r io.ReadCloser, err error) // Returns the sidecar file, or nil if there is none
+}
+
+// ImageModTime is implemented by images that know when their file was modified the last time.
+// This is used to answer conditional HTTP requests.
+type ImageModTime interface {
+	ModTime() time.Time // Returns the modification time of the original image file
+}
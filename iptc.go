@@ -0,0 +1,184 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// IPTCData contains the legacy IPTC-IIM fields that are used by Galago.
+type IPTCData struct {
+	ObjectName string   // 2:05, used as title
+	Keywords   []string // 2:25
+	ByLines    []string // 2:80, the creators
+	City       string   // 2:90
+	Country    string   // 2:101
+	Headline   string   // 2:105
+	Copyright  string   // 2:116
+	Caption    string   // 2:120, used as description
+}
+
+// ReadJPEGIPTC reads the IPTC-IIM data that is stored in the APP13 segments of a JPEG file.
+// This will only read up to the first scan of the JPEG file, the image data itself is not read.
+//
+// If there is no IPTC data, nil will be returned without an error.
+func ReadJPEGIPTC(r io.Reader) (*IPTCData, error) {
+	var result *IPTCData
+
+	err := walkJPEGSegments(r, []byte{jpegMarkerAPP13}, func(marker byte, payload []byte) error {
+		iimData := photoshopIPTCResource(payload)
+		if iimData == nil {
+			return nil
+		}
+		if result == nil {
+			result = &IPTCData{}
+		}
+		result.parseIIM(iimData)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// photoshopIPTCResource returns the IPTC-IIM resource block of an APP13 payload, or nil if there is none.
+func photoshopIPTCResource(payload []byte) []byte {
+	header := []byte("Photoshop 3.0\x00")
+	if !bytes.HasPrefix(payload, header) {
+		return nil
+	}
+	data := payload[len(header):]
+
+	// Go through all image resource blocks
+	for len(data) >= 12 {
+		if !bytes.Equal(data[:4], []byte("8BIM")) {
+			return nil
+		}
+		id := binary.BigEndian.Uint16(data[4:6])
+
+		// The name is a pascal string padded to an even size
+		nameLen := int(data[6]) + 1
+		if nameLen%2 != 0 {
+			nameLen++
+		}
+		if len(data) < 6+nameLen+4 {
+			return nil
+		}
+		data = data[6+nameLen:]
+
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		data = data[4:]
+		if size > len(data) {
+			return nil
+		}
+		if id == 0x0404 {
+			return data[:size]
+		}
+
+		// The resource data is padded to an even size
+		if size%2 != 0 && size < len(data) {
+			size++
+		}
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// parseIIM parses the datasets of an IPTC-IIM stream, and stores the relevant values.
+// Parsing stops at the first byte that isn't a tag marker or at a truncated dataset, datasets before that are kept.
+// This is needed because resource blocks are often padded with zeros.
+func (id *IPTCData) parseIIM(data []byte) {
+	isUTF8 := false
+
+	for len(data) >= 5 && data[0] == 0x1C {
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		data = data[5:]
+
+		// Extended datasets store the length of their size field in the lower 15 bits
+		if size&0x8000 != 0 {
+			sizeLen := size & 0x7FFF
+			if sizeLen > 4 || sizeLen > len(data) {
+				return
+			}
+			size = 0
+			for _, b := range data[:sizeLen] {
+				size = size<<8 | int(b)
+			}
+			data = data[sizeLen:]
+		}
+
+		if size > len(data) {
+			return
+		}
+		value := data[:size]
+		data = data[size:]
+
+		switch record {
+		case 1:
+			// Coded character set, ESC % G is UTF-8
+			if dataset == 90 && bytes.Equal(value, []byte{0x1B, 0x25, 0x47}) {
+				isUTF8 = true
+			}
+
+		case 2:
+			str := decodeIIMString(value, isUTF8)
+			switch dataset {
+			case 5:
+				id.ObjectName = str
+			case 25:
+				id.Keywords = append(id.Keywords, str)
+			case 80:
+				id.ByLines = append(id.ByLines, str)
+			case 90:
+				id.City = str
+			case 101:
+				id.Country = str
+			case 105:
+				id.Headline = str
+			case 116:
+				id.Copyright = str
+			case 120:
+				id.Caption = str
+			}
+		}
+	}
+}
+
+// decodeIIMString converts the value of an IPTC-IIM dataset into a string.
+// Values that are not marked as UTF-8 and are not valid UTF-8 are interpreted as ISO 8859-1.
+func decodeIIMString(value []byte, isUTF8 bool) string {
+	value = bytes.TrimRight(value, "\x00")
+
+	if isUTF8 || utf8.Valid(value) {
+		return strings.TrimSpace(string(value))
+	}
+
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return strings.TrimSpace(string(runes))
+}
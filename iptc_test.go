@@ -0,0 +1,136 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+// testIIMDataset returns an IPTC-IIM dataset with the given value.
+func testIIMDataset(record, dataset byte, value string) []byte {
+	result := []byte{0x1C, record, dataset, byte(len(value) >> 8), byte(len(value))}
+	return append(result, value...)
+}
+
+// testIIMStream concatenates the given datasets.
+func testIIMStream(datasets ...[]byte) []byte {
+	return bytes.Join(datasets, nil)
+}
+
+func TestParseIIM(t *testing.T) {
+	title, caption := testIIMDataset(2, 5, "Title"), testIIMDataset(2, 120, "Caption")
+
+	tests := []struct {
+		name string
+		data []byte
+		want IPTCData
+	}{
+		{"Empty", nil, IPTCData{}},
+		{"Fields", testIIMStream(title, testIIMDataset(2, 25, "cat"), testIIMDataset(2, 25, "dog"), testIIMDataset(2, 80, "Someone"), testIIMDataset(2, 90, "Berlin"), testIIMDataset(2, 101, "Germany"), testIIMDataset(2, 105, "Headline"), testIIMDataset(2, 116, "(c) Someone"), caption),
+			IPTCData{ObjectName: "Title", Keywords: []string{"cat", "dog"}, ByLines: []string{"Someone"}, City: "Berlin", Country: "Germany", Headline: "Headline", Copyright: "(c) Someone", Caption: "Caption"}},
+		{"Unknown records and datasets", testIIMStream(testIIMDataset(1, 0, "\x00\x04"), testIIMDataset(2, 0, "\x00\x04"), testIIMDataset(3, 5, "Other"), title), IPTCData{ObjectName: "Title"}},
+		{"ISO 8859-1", testIIMStream(testIIMDataset(2, 90, "K\xF6ln")), IPTCData{City: "Köln"}},
+		{"UTF-8", testIIMStream(testIIMDataset(1, 90, "\x1B%G"), testIIMDataset(2, 90, "Köln")), IPTCData{City: "Köln"}},
+		{"Padded values", testIIMStream(testIIMDataset(2, 5, " Title\x00\x00")), IPTCData{ObjectName: "Title"}},
+		{"Extended dataset", testIIMStream([]byte{0x1C, 2, 120, 0x80, 0x02, 0x00, 0x07}, []byte("Caption"), title), IPTCData{ObjectName: "Title", Caption: "Caption"}},
+		{"Padded with zeros", testIIMStream(title, caption, make([]byte, 7)), IPTCData{ObjectName: "Title", Caption: "Caption"}},
+		{"Garbage after datasets", testIIMStream(title, []byte("garbage"), caption), IPTCData{ObjectName: "Title"}},
+		{"Truncated dataset", testIIMStream(title, caption[:len(caption)-1]), IPTCData{ObjectName: "Title"}},
+		{"Truncated header", testIIMStream(title, caption[:3]), IPTCData{ObjectName: "Title"}},
+		{"Truncated extended size", testIIMStream(title, []byte{0x1C, 2, 120, 0x80, 0x04, 0x00}), IPTCData{ObjectName: "Title"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := IPTCData{}
+			got.parseIIM(test.data)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// testPhotoshopResource returns an image resource block with the given ID and data.
+func testPhotoshopResource(id uint16, name string, data []byte) []byte {
+	result := new(bytes.Buffer)
+	result.WriteString("8BIM")
+	binary.Write(result, binary.BigEndian, id)
+	result.WriteByte(byte(len(name)))
+	result.WriteString(name)
+	if len(name)%2 == 0 {
+		result.WriteByte(0)
+	}
+	binary.Write(result, binary.BigEndian, uint32(len(data)))
+	result.Write(data)
+	if len(data)%2 != 0 {
+		result.WriteByte(0)
+	}
+	return result.Bytes()
+}
+
+// testJPEGWithAPP13 returns a JPEG file that contains an APP13 segment with the given payload.
+func testJPEGWithAPP13(t *testing.T, payload []byte) []byte {
+	t.Helper()
+
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	file := new(bytes.Buffer)
+	file.Write([]byte{0xFF, jpegMarkerSOI, 0xFF, jpegMarkerAPP13})
+	binary.Write(file, binary.BigEndian, uint16(len(payload)+2))
+	file.Write(payload)
+	file.Write(encoded.Bytes()[2:])
+	return file.Bytes()
+}
+
+func TestReadJPEGIPTC(t *testing.T) {
+	// The IIM stream is padded with zeros, like Photoshop does it
+	iim := testIIMStream(testIIMDataset(2, 5, "Title"), testIIMDataset(2, 25, "cat"), make([]byte, 3))
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    *IPTCData
+	}{
+		{"IPTC resource", append([]byte("Photoshop 3.0\x00"), testPhotoshopResource(0x0404, "", iim)...), &IPTCData{ObjectName: "Title", Keywords: []string{"cat"}}},
+		{"IPTC after other resources", append(append([]byte("Photoshop 3.0\x00"), testPhotoshopResource(0x03ED, "res", []byte("odd"))...), testPhotoshopResource(0x0404, "", iim)...), &IPTCData{ObjectName: "Title", Keywords: []string{"cat"}}},
+		{"Without IPTC resource", append([]byte("Photoshop 3.0\x00"), testPhotoshopResource(0x03ED, "", []byte("data"))...), nil},
+		{"Truncated resource", append([]byte("Photoshop 3.0\x00"), testPhotoshopResource(0x0404, "", iim)[:20]...), nil},
+		{"Other APP13 data", []byte("Other"), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ReadJPEGIPTC(bytes.NewReader(testJPEGWithAPP13(t, test.payload)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
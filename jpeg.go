@@ -0,0 +1,106 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// JPEG markers that are used by Galago.
+const (
+	jpegMarkerSOI   = 0xD8
+	jpegMarkerEOI   = 0xD9
+	jpegMarkerSOS   = 0xDA
+	jpegMarkerAPP1  = 0xE1
+	jpegMarkerAPP2  = 0xE2
+	jpegMarkerAPP13 = 0xED
+	jpegMarkerCOM   = 0xFE
+)
+
+// walkJPEGSegments calls f with the payload of every segment of the given markers in a JPEG file.
+// This will stop at the first scan of the JPEG file, so the image data itself is not read.
+// Segments of other markers are skipped without reading their payload into memory.
+//
+// If f returns an error, walking is stopped and the error is returned.
+func walkJPEGSegments(r io.Reader, markers []byte, f func(marker byte, payload []byte) error) error {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return err
+	}
+	if soi != [2]byte{0xFF, jpegMarkerSOI} {
+		return fmt.Errorf("missing JPEG SOI marker")
+	}
+
+	wanted := map[byte]bool{}
+	for _, marker := range markers {
+		wanted[marker] = true
+	}
+
+	for {
+		// Read marker, skip any fill bytes
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xFF {
+			return fmt.Errorf("expected JPEG marker, got 0x%02X", b)
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case marker == jpegMarkerSOS || marker == jpegMarkerEOI: // There are no more metadata segments
+			return nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01: // Markers without any payload
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length < 2 {
+			return fmt.Errorf("invalid JPEG segment length %d", length)
+		}
+
+		if !wanted[marker] {
+			if _, err := br.Discard(int(length) - 2); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payload := make([]byte, int(length)-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+
+		if err := f(marker, payload); err != nil {
+			return err
+		}
+	}
+}
@@ -92,7 +92,72 @@ func main() {
 		log.Fatalf("Can't load cache path from config files: %v", err)
 	}
 	os.MkdirAll(cachePath, os.ModePerm)
-	cache = NewCache(cachePath)
+	var cacheOptions CacheOptions
+	if err := conf.Get(".Cache.RenditionHeights", &cacheOptions.RenditionHeights); err != nil {
+		cacheOptions.RenditionHeights = []int{240, 480, 1080, 2160}
+		log.Warnf("Can't load rendition heights from config files, using the default %v: %v", cacheOptions.RenditionHeights, err)
+	}
+	if err := conf.Get(".Cache.Formats", &cacheOptions.Formats); err != nil {
+		cacheOptions.Formats = []string{}
+		log.Warnf("Can't load cache formats from config files, using the default %v: %v", cacheOptions.Formats, err)
+	}
+	conf.Get(".Cache.JPEGQuality", &cacheOptions.JPEGQuality) // Optional, NewCache uses a default value if not set
+	conf.Get(".Cache.WebPQuality", &cacheOptions.WebPQuality) // Optional, NewCache uses a default value if not set
+	var memorySizeMB int64
+	if err := conf.Get(".Cache.MemorySizeMB", &memorySizeMB); err != nil {
+		memorySizeMB = 16
+		log.Warnf("Can't load the size of the in-memory cache from config files, using the default of %v MB: %v", memorySizeMB, err)
+	}
+	cacheOptions.MemorySize = memorySizeMB * 1024 * 1024
+	var maxSizeMB int64
+	conf.Get(".Cache.MaxSizeMB", &maxSizeMB) // Optional, the cache is unlimited if not set
+	cacheOptions.MaxSize = maxSizeMB * 1024 * 1024
+	var maxMegapixels int64
+	if err := conf.Get(".Cache.MaxMegapixels", &maxMegapixels); err != nil {
+		maxMegapixels = 100
+		log.Warnf("Can't load the maximum number of megapixels from config files, using the default %v: %v", maxMegapixels, err)
+	}
+	cacheOptions.MaxPixels = maxMegapixels * 1000 * 1000
+	conf.Get(".Cache.MaxDecodes", &cacheOptions.MaxDecodes) // Optional, NewCache uses the number of CPUs if not set
+	if err := conf.Get(".Cache.Storage", &cacheOptions.Storage); err != nil {
+		cacheOptions.Storage = "flat"
+		log.Warnf("Can't load cache storage type from config files, using the default %q: %v", cacheOptions.Storage, err)
+	}
+	if cache, err = NewCache(cachePath, cacheOptions); err != nil {
+		log.Fatalf("Can't create cache: %v", err)
+	}
+
+	if chc, err := openContentHashCache(filepath.Join(cachePath, "content-hashes.txt")); err != nil {
+		log.Warnf("Can't open content hash cache, content hashes will not be persisted: %v", err)
+	} else {
+		contentHashes = chc
+	}
+
+	// Run a command instead of the webserver, if there is any given
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("Command %q failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	var warmUpWorkers int
+	if err := conf.Get(".Cache.WarmUpWorkers", &warmUpWorkers); err != nil {
+		warmUpWorkers = 1
+		log.Warnf("Can't load the number of cache warm-up workers from config files, using the default %v: %v", warmUpWorkers, err)
+	}
+	cacheWarmer = NewCacheWarmer(warmUpWorkers)
+
+	var gcIntervalString string
+	if err := conf.Get(".Cache.GCInterval", &gcIntervalString); err != nil {
+		log.Warnf("Can't load cache garbage collection interval from config files, disabling it: %v", err)
+	} else if gcInterval, err := time.ParseDuration(gcIntervalString); err != nil {
+		log.Warnf("Invalid cache garbage collection interval %q, disabling it: %v", gcIntervalString, err)
+	} else if gcInterval > 0 {
+		cache.StartGarbageCollection(gcInterval)
+	}
+
+	initSessionKey()
 
 	// Add routes to the webserver
 	serverUIInit()
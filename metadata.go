@@ -0,0 +1,103 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// The metadata of an image can come from several places.
+// They are applied to the cache entry in the following order, where later ones overwrite the values of earlier ones:
+//
+//	1. IPTC-IIM data from JPEG APP13 segments
+//	2. XMP data embedded in the image file
+//	3. XMP data from a sidecar file
+//
+// So for any field that is set in several places, XMP takes precedence over IPTC-IIM.
+// Fields that are empty in a source with higher precedence don't overwrite the values of sources with lower precedence.
+
+import (
+	"strconv"
+
+	"trimmer.io/go-xmp/models/dc"
+	xmpbase "trimmer.io/go-xmp/models/xmp_base"
+	"trimmer.io/go-xmp/xmp"
+)
+
+// applyXMP copies the metadata of the given XMP document into the cache entry.
+//
+// Only values that are set in the document will overwrite the values of the cache entry.
+// This allows to layer several documents on top of each other, where the last applied document takes precedence.
+func (ce *CacheEntry) applyXMP(d *xmp.Document) {
+	// Retrieve some values from the XMP namespace
+	xmpNS := d.FindNs("xmp", "http://ns.adobe.com/xap/1.0/")
+	if xmpModel, ok := d.FindModel(xmpNS).(*xmpbase.XmpBase); ok {
+		// Rating
+		if rating, err := xmpModel.GetTag("Rating"); err == nil {
+			if ratingInt, err := strconv.ParseInt(rating, 10, 0); err == nil {
+				ce.Rating = int(ratingInt)
+			}
+		}
+	}
+
+	// Retrieve some values from the DC namespace
+	dcNS := d.FindNs("dc", "http://purl.org/dc/elements/1.1/")
+	if dcModel, ok := d.FindModel(dcNS).(*dc.DublinCore); ok {
+		if title := dcModel.Title.Default(); title != "" {
+			ce.Title = title
+		}
+		if description := dcModel.Description.Default(); description != "" {
+			ce.Description = description
+		}
+		if len(dcModel.Subject) > 0 {
+			ce.Tags = []string(dcModel.Subject)
+		}
+		if len(dcModel.Creator) > 0 {
+			ce.Creators = []string(dcModel.Creator)
+		}
+		if rights := dcModel.Rights.Default(); rights != "" {
+			ce.Copyright = rights
+		}
+	}
+}
+
+// applyIPTC copies the IPTC-IIM metadata into the cache entry.
+//
+// Like with applyXMP, only values that are set will overwrite the values of the cache entry.
+// The object name is used as title, and the headline as fallback if there is no object name.
+func (ce *CacheEntry) applyIPTC(id *IPTCData) {
+	if id.ObjectName != "" {
+		ce.Title = id.ObjectName
+	} else if id.Headline != "" {
+		ce.Title = id.Headline
+	}
+	if id.Caption != "" {
+		ce.Description = id.Caption
+	}
+	if len(id.Keywords) > 0 {
+		ce.Tags = id.Keywords
+	}
+	if len(id.ByLines) > 0 {
+		ce.Creators = id.ByLines
+	}
+	if id.Copyright != "" {
+		ce.Copyright = id.Copyright
+	}
+	if id.City != "" {
+		ce.City = id.City
+	}
+	if id.Country != "" {
+		ce.Country = id.Country
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// MetadataPolicy defines which metadata is removed from original image files before they are sent to the browser.
+//
+// Reduced images in the cache never contain any metadata besides ICC profiles, so they don't need to be stripped.
+type MetadataPolicy struct {
+	GPS    bool // Remove GPS coordinates and other location data
+	Serial bool // Remove serial numbers of cameras and lenses, including maker notes which often contain them
+	All    bool // Remove all EXIF, XMP and IPTC metadata, and comments
+}
+
+// ParseMetadataPolicy returns the policy described by a configuration value.
+// The value is either a single string or a list of strings, possible values are "gps", "serial" and "all".
+func ParseMetadataPolicy(value interface{}) (MetadataPolicy, error) {
+	var values []interface{}
+	switch value := value.(type) {
+	case nil:
+	case string:
+		values = []interface{}{value}
+	case []interface{}:
+		values = value
+	default:
+		return MetadataPolicy{}, fmt.Errorf("Invalid metadata policy %v", value)
+	}
+
+	p := MetadataPolicy{}
+	for _, v := range values {
+		switch v {
+		case "gps":
+			p.GPS = true
+		case "serial":
+			p.Serial = true
+		case "all":
+			p.All = true
+		default:
+			return MetadataPolicy{}, fmt.Errorf("Unknown metadata policy %q", v)
+		}
+	}
+
+	return p, nil
+}
+
+// IsEmpty returns whether the policy doesn't remove any metadata.
+func (p MetadataPolicy) IsEmpty() bool {
+	return !p.GPS && !p.Serial && !p.All
+}
+
+func (p MetadataPolicy) String() string {
+	names := []string{}
+	if p.GPS {
+		names = append(names, "gps")
+	}
+	if p.Serial {
+		names = append(names, "serial")
+	}
+	if p.All {
+		names = append(names, "all")
+	}
+	return strings.Join(names, "-")
+}
+
+// ImageMetadataPolicy is implemented by images whose metadata has to be removed before they are sent to the browser.
+type ImageMetadataPolicy interface {
+	MetadataPolicy() MetadataPolicy // Returns the metadata policy of the source of the image
+}
+
+// imageMetadataPolicy returns the metadata policy of the image, or an empty policy if there is none.
+func imageMetadataPolicy(img Image) MetadataPolicy {
+	if i, ok := img.(ImageMetadataPolicy); ok {
+		return i.MetadataPolicy()
+	}
+	return MetadataPolicy{}
+}
+
+// strippedFile is a file whose header has been replaced by a rewritten version.
+// It is seekable, so conditional and range requests still work.
+type strippedFile struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// StripMetadata returns the content of the given original image file with metadata removed according to the policy.
+// The file has to implement io.ReaderAt, and will be closed when the returned file is closed.
+//
+// Only JPEG files are supported, any other file is returned unchanged.
+// The image data isn't re-encoded, only the metadata segments in front of it are rewritten, and the ones between its scans are removed.
+// Everything after the end of the primary image is dropped, as it may contain further images with their own metadata,
+// like the secondary images of the multi-picture format (MPF), or vendor specific trailers.
+func StripMetadata(file io.ReadCloser, size int64, mime string, p MetadataPolicy) (io.ReadSeekCloser, int64, error) {
+	ra, ok := file.(io.ReaderAt)
+	if !ok {
+		return nil, 0, fmt.Errorf("Couldn't strip metadata, the file doesn't support random access")
+	}
+
+	if p.IsEmpty() || mime != "image/jpeg" {
+		return strippedFile{io.NewSectionReader(ra, 0, size), file}, size, nil
+	}
+
+	header, ranges, err := stripJPEGMetadata(io.NewSectionReader(ra, 0, size), p)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Couldn't strip metadata: %w", err)
+	}
+
+	parts := []*io.SectionReader{io.NewSectionReader(bytes.NewReader(header), 0, int64(len(header)))}
+	for _, fr := range ranges {
+		parts = append(parts, io.NewSectionReader(ra, fr.offset, fr.size))
+	}
+	r := newConcatReadSeeker(parts...)
+
+	return strippedFile{r, file}, r.size, nil
+}
+
+// fileRange is a range of bytes inside a file.
+type fileRange struct {
+	offset, size int64
+}
+
+// stripJPEGMetadata reads all segments up to the first scan of the JPEG file, and returns them with metadata removed according to the policy.
+// The returned ranges cover the image data from the first scan up to the EOI marker of the primary image,
+// they can be copied without modification.
+//
+// Segments that should be modified, but can't be parsed, are removed completely.
+func stripJPEGMetadata(r io.Reader, p MetadataPolicy) ([]byte, []fileRange, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	out := new(bytes.Buffer)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, nil, err
+	}
+	if soi != [2]byte{0xFF, jpegMarkerSOI} {
+		return nil, nil, fmt.Errorf("missing JPEG SOI marker")
+	}
+	offset += 2
+	out.Write(soi[:])
+
+	for {
+		// Read marker, skip any fill bytes
+		markerOffset := offset
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		offset++
+		if b != 0xFF {
+			return nil, nil, fmt.Errorf("expected JPEG marker, got 0x%02X", b)
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return nil, nil, err
+			}
+			offset++
+		}
+
+		switch {
+		case marker == jpegMarkerEOI: // Image without any scan
+			return out.Bytes(), []fileRange{{markerOffset, offset - markerOffset}}, nil
+		case marker == jpegMarkerSOS: // Everything from here on is image data
+			ranges, err := jpegImageRanges(br, markerOffset, offset)
+			if err != nil {
+				return nil, nil, err
+			}
+			return out.Bytes(), ranges, nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01: // Markers without any payload
+			out.Write([]byte{0xFF, marker})
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return nil, nil, err
+		}
+		if length < 2 {
+			return nil, nil, fmt.Errorf("invalid JPEG segment length %d", length)
+		}
+		payload := make([]byte, int(length)-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return nil, nil, err
+		}
+		offset += int64(length)
+
+		payload, keep := stripJPEGSegment(marker, payload, p)
+		if !keep {
+			continue
+		}
+		if len(payload)+2 > 0xFFFF {
+			return nil, nil, fmt.Errorf("JPEG segment too large after stripping")
+		}
+
+		out.Write([]byte{0xFF, marker})
+		binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+		out.Write(payload)
+	}
+}
+
+// jpegImageRanges reads the scans of a JPEG image, starting right after its first SOS marker.
+// start is the offset of the SOS marker, offset the one right after it.
+// It returns the ranges of the image data up to and including the EOI marker, or up to the end of the file if the image is truncated.
+//
+// Metadata segments between the scans, like in some progressive JPEG files, are not part of the returned ranges.
+// They are removed completely regardless of the policy, as they are not needed to decode the image.
+func jpegImageRanges(br *bufio.Reader, start, offset int64) ([]fileRange, error) {
+	ranges := []fileRange{}
+	marker := byte(jpegMarkerSOS)
+	for {
+		switch {
+		case marker == jpegMarkerEOI:
+			return append(ranges, fileRange{start, offset - start}), nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x00, marker == 0x01: // Restart markers, stuffed bytes and markers without any payload
+		default:
+			var length uint16
+			if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+				return nil, err
+			}
+			if length < 2 {
+				return nil, fmt.Errorf("invalid JPEG segment length %d", length)
+			}
+			if _, err := br.Discard(int(length) - 2); err != nil {
+				return nil, err
+			}
+
+			if marker >= 0xE0 && marker <= 0xEF || marker == jpegMarkerCOM {
+				markerOffset := offset - 2
+				ranges = append(ranges, fileRange{start, markerOffset - start})
+				start = markerOffset + int64(length) + 2
+			}
+			offset += int64(length)
+		}
+
+		// Skip entropy coded data up to the next marker, and any fill bytes
+		b, err := br.ReadByte()
+		for ; err == nil && b != 0xFF; b, err = br.ReadByte() {
+			offset++
+		}
+		for ; err == nil && b == 0xFF; b, err = br.ReadByte() {
+			offset++
+		}
+		if err == io.EOF {
+			return append(ranges, fileRange{start, offset - start}), nil
+		} else if err != nil {
+			return nil, err
+		}
+		offset++
+		marker = b
+	}
+}
+
+const (
+	jpegEXIFHeader        = "Exif\x00\x00"
+	jpegXMPHeader         = "http://ns.adobe.com/xap/1.0/\x00"
+	jpegXMPExtendedHeader = "http://ns.adobe.com/xmp/extension/\x00"
+	jpegMPFHeader         = "MPF\x00"
+)
+
+// stripJPEGSegment returns the payload of the segment with metadata removed according to the policy.
+// The boolean is false if the whole segment has to be removed.
+func stripJPEGSegment(marker byte, payload []byte, p MetadataPolicy) ([]byte, bool) {
+	switch marker {
+	case jpegMarkerAPP1:
+		switch {
+		case p.All:
+			return nil, false
+
+		case bytes.HasPrefix(payload, []byte(jpegEXIFHeader)):
+			tiff := append([]byte{}, payload[len(jpegEXIFHeader):]...)
+			if err := stripEXIF(tiff, p); err != nil {
+				log.Warnf("Couldn't parse EXIF metadata, removing it completely: %v", err)
+				return nil, false
+			}
+			return append([]byte(jpegEXIFHeader), tiff...), true
+
+		case bytes.HasPrefix(payload, []byte(jpegXMPHeader)):
+			return append([]byte(jpegXMPHeader), stripXMP(payload[len(jpegXMPHeader):], p)...), true
+
+		case bytes.HasPrefix(payload, []byte(jpegXMPExtendedHeader)):
+			// Extended XMP is split into chunks that can't be processed separately, so it's removed completely
+			return nil, false
+		}
+
+	case jpegMarkerAPP2:
+		// The index of the multi-picture format points to images after the primary one, which are dropped by StripMetadata
+		if bytes.HasPrefix(payload, []byte(jpegMPFHeader)) {
+			return nil, false
+		}
+
+	case jpegMarkerAPP13, jpegMarkerCOM:
+		if p.All {
+			return nil, false
+		}
+	}
+
+	return payload, true
+}
+
+// EXIF tags that are removed by stripEXIF.
+const (
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagMakerNote        = 0x927C
+	exifTagBodySerialNumber = 0xA431
+	exifTagLensSerialNumber = 0xA435
+)
+
+// exifTypeSizes contains the size of a single value of every EXIF data type.
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// stripEXIF removes metadata from the given TIFF structure of an EXIF segment, according to the policy.
+// The data is overwritten with zeros in place, so no offsets inside of the structure change.
+//
+// GPS data is removed by clearing all entries of the GPS IFD, serial numbers by clearing the values of their tags.
+func stripEXIF(tiff []byte, p MetadataPolicy) error {
+	if len(tiff) < 8 {
+		return fmt.Errorf("EXIF data too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return fmt.Errorf("invalid TIFF byte order %q", tiff[:2])
+	}
+
+	// entries returns the offsets of all entries of the IFD at the given offset
+	entries := func(ifdOffset uint32) ([]int, error) {
+		if int64(ifdOffset)+2 > int64(len(tiff)) {
+			return nil, fmt.Errorf("IFD offset %d out of bounds", ifdOffset)
+		}
+		n := int(order.Uint16(tiff[ifdOffset:]))
+		if int64(ifdOffset)+2+int64(n)*12 > int64(len(tiff)) {
+			return nil, fmt.Errorf("IFD at offset %d out of bounds", ifdOffset)
+		}
+		result := make([]int, n)
+		for i := range result {
+			result[i] = int(ifdOffset) + 2 + i*12
+		}
+		return result, nil
+	}
+
+	// clearValue overwrites the value of the entry at the given offset with zeros
+	clearValue := func(entry int) error {
+		size := int64(exifTypeSizes[order.Uint16(tiff[entry+2:])]) * int64(order.Uint32(tiff[entry+4:]))
+		if size <= 4 {
+			copy(tiff[entry+8:entry+12], make([]byte, 4))
+			return nil
+		}
+		valueOffset := int64(order.Uint32(tiff[entry+8:]))
+		if valueOffset+size > int64(len(tiff)) {
+			return fmt.Errorf("value of tag 0x%04X out of bounds", order.Uint16(tiff[entry:]))
+		}
+		copy(tiff[valueOffset:valueOffset+size], make([]byte, size))
+		return nil
+	}
+
+	ifd0, err := entries(order.Uint32(tiff[4:]))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range ifd0 {
+		switch order.Uint16(tiff[entry:]) {
+		case exifTagGPSIFD:
+			if !p.GPS {
+				continue
+			}
+			ifdOffset := order.Uint32(tiff[entry+8:])
+			gpsEntries, err := entries(ifdOffset)
+			if err != nil {
+				return err
+			}
+			for _, gpsEntry := range gpsEntries {
+				if err := clearValue(gpsEntry); err != nil {
+					return err
+				}
+			}
+			// Clear the entries, and leave an empty IFD without any following IFD
+			copy(tiff[ifdOffset:int(ifdOffset)+2+len(gpsEntries)*12], make([]byte, 2+len(gpsEntries)*12))
+
+		case exifTagExifIFD:
+			if !p.Serial {
+				continue
+			}
+			exifEntries, err := entries(order.Uint32(tiff[entry+8:]))
+			if err != nil {
+				return err
+			}
+			for _, exifEntry := range exifEntries {
+				switch order.Uint16(tiff[exifEntry:]) {
+				case exifTagBodySerialNumber, exifTagLensSerialNumber, exifTagMakerNote:
+					if err := clearValue(exifEntry); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// XMP properties that are removed by stripXMP, as regular expressions matching their local names.
+const (
+	xmpGPSProperties    = `GPS\w*`
+	xmpSerialProperties = `(?:Body|Lens|Camera)?SerialNumber`
+)
+
+// xmpPropertyPatterns returns the regular expressions that match the properties with the given local names.
+// Properties can be written as attributes, empty elements or elements with content.
+func xmpPropertyPatterns(localNames string) []*regexp.Regexp {
+	name := `[\w.-]+:(?:` + localNames + `)`
+	return []*regexp.Regexp{
+		regexp.MustCompile(`\s` + name + `\s*=\s*(?:"[^"]*"|'[^']*')`),
+		regexp.MustCompile(`<` + name + `(?:\s[^>]*)?/>`),
+		regexp.MustCompile(`(?s)<` + name + `(?:\s[^>]*)?>.*?</` + name + `\s*>`),
+	}
+}
+
+var (
+	xmpGPSPatterns    = xmpPropertyPatterns(xmpGPSProperties)
+	xmpSerialPatterns = xmpPropertyPatterns(xmpSerialProperties)
+)
+
+// stripXMP returns the XMP packet with properties removed according to the policy.
+func stripXMP(packet []byte, p MetadataPolicy) []byte {
+	patterns := []*regexp.Regexp{}
+	if p.GPS {
+		patterns = append(patterns, xmpGPSPatterns...)
+	}
+	if p.Serial {
+		patterns = append(patterns, xmpSerialPatterns...)
+	}
+
+	for _, pattern := range patterns {
+		packet = pattern.ReplaceAll(packet, nil)
+	}
+
+	return packet
+}
+
+// concatReadSeeker is a seekable concatenation of several sections.
+type concatReadSeeker struct {
+	parts        []*io.SectionReader
+	size, offset int64
+}
+
+func newConcatReadSeeker(parts ...*io.SectionReader) *concatReadSeeker {
+	c := &concatReadSeeker{parts: parts}
+	for _, part := range parts {
+		c.size += part.Size()
+	}
+	return c
+}
+
+func (c *concatReadSeeker) Read(p []byte) (int, error) {
+	var start int64
+	for _, part := range c.parts {
+		end := start + part.Size()
+		if c.offset >= end {
+			start = end
+			continue
+		}
+
+		if int64(len(p)) > end-c.offset {
+			p = p[:end-c.offset]
+		}
+		n, err := part.ReadAt(p, c.offset-start)
+		c.offset += int64(n)
+		if err == io.EOF && n == len(p) {
+			err = nil
+		}
+		return n, err
+	}
+
+	return 0, io.EOF
+}
+
+func (c *concatReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	c.offset = offset
+	return offset, nil
+}
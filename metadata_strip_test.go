@@ -0,0 +1,259 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testJPEGSegment is a segment of a JPEG file in front of the first scan.
+type testJPEGSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// splitTestJPEG returns the segments in front of the first scan of the given JPEG file, and everything from the SOS marker on.
+func splitTestJPEG(t *testing.T, data []byte) ([]testJPEGSegment, []byte) {
+	t.Helper()
+
+	segments := []testJPEGSegment{}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			t.Fatalf("Expected JPEG marker at offset %d, got 0x%02X", i, data[i])
+		}
+		marker := data[i+1]
+		if marker == jpegMarkerSOS {
+			return segments, data[i:]
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		segments = append(segments, testJPEGSegment{marker, data[i+4 : i+2+length]})
+		i += 2 + length
+	}
+
+	t.Fatal("JPEG file without SOS marker")
+	return nil, nil
+}
+
+// testMetadataJPEG returns a JPEG file with EXIF, XMP, MPF and IPTC segments, a comment, and an appended image and trailer.
+// The second result is everything from the first SOS marker up to the EOI marker of the primary image.
+func testMetadataJPEG(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	encodedSegments, scans := splitTestJPEG(t, encoded.Bytes())
+
+	// Big endian TIFF structure with an IFD0 that points to a GPS IFD at offset 26.
+	// The GPS IFD contains a latitude reference and a latitude, whose value is stored at offset 56
+	tiff := []byte("MM\x00\x2A\x00\x00\x00\x08")
+	tiff = append(tiff, 0x00, 0x01, 0x88, 0x25, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x1A, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x02)
+	tiff = append(tiff, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x02, 'N', 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x02, 0x00, 0x05, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x38)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+	for _, v := range []uint32{52, 1, 31, 1, 12, 1} {
+		tiff = append(tiff, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" xmlns:tiff="http://ns.adobe.com/tiff/1.0/" exif:GPSLatitude="52,31.2N" tiff:Make="Camera">` +
+		`<exif:GPSLongitude>13,24.6E</exif:GPSLongitude></rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	segments := []testJPEGSegment{
+		{jpegMarkerAPP1, append([]byte(jpegEXIFHeader), tiff...)},
+		{jpegMarkerAPP1, append([]byte(jpegXMPHeader), xmp...)},
+		{jpegMarkerAPP2, append([]byte(jpegMPFHeader), "MM\x00\x2A\x00\x00\x00\x08"...)},
+		{jpegMarkerAPP13, []byte("Photoshop 3.0\x00")},
+		{jpegMarkerCOM, []byte("comment")},
+	}
+
+	file := new(bytes.Buffer)
+	file.Write([]byte{0xFF, jpegMarkerSOI})
+	for _, segment := range append(segments, encodedSegments...) {
+		file.Write([]byte{0xFF, segment.marker})
+		binary.Write(file, binary.BigEndian, uint16(len(segment.payload)+2))
+		file.Write(segment.payload)
+	}
+	file.Write(scans)
+
+	// Secondary image of the multi-picture format with its own EXIF data, and a vendor specific trailer
+	file.Write([]byte{0xFF, jpegMarkerSOI, 0xFF, jpegMarkerAPP1})
+	binary.Write(file, binary.BigEndian, uint16(len(segments[0].payload)+2))
+	file.Write(segments[0].payload)
+	file.Write(encoded.Bytes()[2:])
+	file.Write([]byte("SEFH\x00\x00\x00\x00SEFT"))
+
+	return file.Bytes(), scans
+}
+
+// testReaderAtCloser is an in-memory file for StripMetadata.
+type testReaderAtCloser struct {
+	*bytes.Reader
+}
+
+func (testReaderAtCloser) Close() error { return nil }
+
+func TestStripMetadataJPEG(t *testing.T) {
+	data, scans := testMetadataJPEG(t)
+
+	strip := func(p MetadataPolicy) []testJPEGSegment {
+		t.Helper()
+
+		r, size, err := StripMetadata(testReaderAtCloser{bytes.NewReader(data)}, int64(len(data)), "image/jpeg", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		stripped, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(stripped)) != size {
+			t.Errorf("Policy %v: Got %d bytes, but the returned size is %d", p, len(stripped), size)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("Policy %v: Couldn't decode stripped file: %v", p, err)
+		}
+
+		// The scan data has to be unchanged, and nothing may follow the primary image
+		segments, rest := splitTestJPEG(t, stripped)
+		if !bytes.Equal(rest, scans) {
+			t.Errorf("Policy %v: Scan data differs from the original, got %d bytes, want %d", p, len(rest), len(scans))
+		}
+
+		for _, segment := range segments {
+			if segment.marker == jpegMarkerAPP2 && bytes.HasPrefix(segment.payload, []byte(jpegMPFHeader)) {
+				t.Errorf("Policy %v: MPF segment wasn't removed", p)
+			}
+		}
+		return segments
+	}
+
+	var exif, xmp []byte
+	markers := map[byte]int{}
+	for _, segment := range strip(MetadataPolicy{GPS: true}) {
+		markers[segment.marker]++
+		switch {
+		case bytes.HasPrefix(segment.payload, []byte(jpegEXIFHeader)):
+			exif = segment.payload[len(jpegEXIFHeader):]
+		case bytes.HasPrefix(segment.payload, []byte(jpegXMPHeader)):
+			xmp = segment.payload[len(jpegXMPHeader):]
+		}
+	}
+	if exif == nil {
+		t.Error("EXIF segment was removed by GPS policy")
+	} else if gpsIFD := exif[26:80]; !bytes.Equal(gpsIFD, make([]byte, len(gpsIFD))) {
+		t.Errorf("GPS IFD wasn't cleared: % X", gpsIFD)
+	}
+	if xmp == nil {
+		t.Error("XMP segment was removed by GPS policy")
+	} else if bytes.Contains(xmp, []byte("GPS")) || !bytes.Contains(xmp, []byte(`tiff:Make="Camera"`)) {
+		t.Errorf("Unexpected XMP packet after removing GPS properties: %s", xmp)
+	}
+	if markers[jpegMarkerAPP13] != 1 || markers[jpegMarkerCOM] != 1 {
+		t.Errorf("IPTC segment or comment was removed by GPS policy")
+	}
+
+	for _, segment := range strip(MetadataPolicy{All: true}) {
+		switch segment.marker {
+		case jpegMarkerAPP1, jpegMarkerAPP13, jpegMarkerCOM:
+			t.Errorf("Segment 0x%02X wasn't removed by policy %v", segment.marker, MetadataPolicy{All: true})
+		}
+	}
+}
+
+// testProgressiveJPEG returns a progressive 8x8 grayscale JPEG file with a DC and an AC scan.
+// The given segments are inserted between the two scans.
+func testProgressiveJPEG(between ...testJPEGSegment) []byte {
+	// All quantization factors are 1, and both Huffman tables contain a single symbol with the code 0
+	huffmanTable := append([]byte{1}, make([]byte, 15)...)
+
+	file := new(bytes.Buffer)
+	file.Write([]byte{0xFF, jpegMarkerSOI})
+	writeSegment := func(segment testJPEGSegment) {
+		file.Write([]byte{0xFF, segment.marker})
+		binary.Write(file, binary.BigEndian, uint16(len(segment.payload)+2))
+		file.Write(segment.payload)
+	}
+	writeSegment(testJPEGSegment{0xDB, append([]byte{0x00}, bytes.Repeat([]byte{1}, 64)...)}) // DQT
+	writeSegment(testJPEGSegment{0xC2, []byte{8, 0, 8, 0, 8, 1, 1, 0x11, 0}})                 // SOF2
+	writeSegment(testJPEGSegment{0xC4, append(append([]byte{0x00}, huffmanTable...), 0x00)})  // DHT: DC category 0
+	writeSegment(testJPEGSegment{0xC4, append(append([]byte{0x10}, huffmanTable...), 0x00)})  // DHT: AC end of band
+	writeSegment(testJPEGSegment{jpegMarkerSOS, []byte{1, 1, 0x00, 0, 0, 0}})                 // DC scan
+	file.WriteByte(0x7F)
+	for _, segment := range between {
+		writeSegment(segment)
+	}
+	writeSegment(testJPEGSegment{jpegMarkerSOS, []byte{1, 1, 0x00, 1, 63, 0}}) // AC scan
+	file.WriteByte(0x7F)
+	file.Write([]byte{0xFF, jpegMarkerEOI})
+
+	return file.Bytes()
+}
+
+func TestStripMetadataJPEGBetweenScans(t *testing.T) {
+	want := testProgressiveJPEG()
+	data := testProgressiveJPEG(testJPEGSegment{jpegMarkerCOM, []byte("comment")}, testJPEGSegment{jpegMarkerAPP1, append([]byte(jpegEXIFHeader), "MM\x00\x2A\x00\x00\x00\x08"...)})
+
+	if img, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Couldn't decode test image: %v", err)
+	} else if c := img.At(4, 4).(color.Gray); c.Y != 128 {
+		t.Fatalf("Got color %v in test image, want gray 128", c)
+	}
+
+	for _, p := range []MetadataPolicy{{GPS: true}, {All: true}} {
+		r, size, err := StripMetadata(testReaderAtCloser{bytes.NewReader(data)}, int64(len(data)), "image/jpeg", p)
+		if err != nil {
+			t.Fatalf("Policy %v: %v", p, err)
+		}
+		stripped, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(stripped)) != size {
+			t.Errorf("Policy %v: Got %d bytes, but the returned size is %d", p, len(stripped), size)
+		}
+		if !bytes.Equal(stripped, want) {
+			t.Errorf("Policy %v: Segments between the scans weren't removed, got % X, want % X", p, stripped, want)
+		}
+
+		// Seeking into the scan after the removed segments
+		if _, err := r.Seek(-3, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if tail, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(tail, want[len(want)-3:]) {
+			t.Errorf("Policy %v: Got % X, %v after seeking to the end, want % X", p, tail, err, want[len(want)-3:])
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"gopkg.in/yaml.v2"
+)
+
+// Protection is a password that protects an element and everything inside of it.
+type Protection struct {
+	key      string // Identifies the protection in cookies and URLs, derived from the place where it's defined
+	name     string // The name of the protected element, shown on the login page
+	password string
+}
+
+// protectionCookiePrefix is the prefix of the names of session cookies.
+// Every protection has its own cookie, so unlocking one doesn't affect others.
+const protectionCookiePrefix = "galago-session-"
+
+// protectionSessionDuration is the time after which visitors have to log in again.
+const protectionSessionDuration = 30 * 24 * time.Hour
+
+// protectionLoginDelay is the time a failed login attempt takes, to slow down guessing of passwords.
+const protectionLoginDelay = 1 * time.Second
+
+// Failed login attempts are limited per IP address and per protection, so passwords can't be guessed by sending many attempts in parallel.
+// Only failed attempts are counted, and a successful login resets the counter of its IP address.
+//
+// The limit per protection doesn't lock out everyone once it's reached, it only blocks IP addresses that already failed within the window.
+// That way a distributed attack can't prevent visitors from logging in, but it only gets a single guess per IP address.
+const (
+	loginFailuresPerIP         = 10
+	loginFailuresPerProtection = 100
+	loginFailureWindow         = 15 * time.Minute
+)
+
+// loginFailures counts the failed login attempts of the current window, by IP address and by protection.
+var loginFailures = &loginThrottle{failures: map[string]*loginFailureCount{}}
+
+type loginThrottle struct {
+	sync.Mutex
+	failures map[string]*loginFailureCount
+}
+
+type loginFailureCount struct {
+	count int
+	start time.Time // Start of the window
+}
+
+// count returns the number of failed attempts of the given key within the current window.
+func (lt *loginThrottle) count(key string) int {
+	lt.Lock()
+	defer lt.Unlock()
+
+	if f, ok := lt.failures[key]; ok && time.Since(f.start) < loginFailureWindow {
+		return f.count
+	}
+	return 0
+}
+
+// allow returns whether an attempt for the given protection from the given IP address can be made.
+func (lt *loginThrottle) allow(ip, protectionKey string) bool {
+	ipFailures := lt.count("ip " + ip)
+	if ipFailures >= loginFailuresPerIP {
+		return false
+	}
+	return ipFailures == 0 || lt.count("protection "+protectionKey) < loginFailuresPerProtection
+}
+
+// fail counts a failed attempt for the given protection from the given IP address.
+func (lt *loginThrottle) fail(ip, protectionKey string) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{"ip " + ip, "protection " + protectionKey} {
+		f, ok := lt.failures[key]
+		if !ok || now.Sub(f.start) >= loginFailureWindow {
+			f = &loginFailureCount{start: now}
+			lt.failures[key] = f
+		}
+		f.count++
+	}
+
+	// Forget old windows once in a while
+	if len(lt.failures) > 1024 {
+		for key, f := range lt.failures {
+			if now.Sub(f.start) >= loginFailureWindow {
+				delete(lt.failures, key)
+			}
+		}
+	}
+}
+
+// reset forgets all failed attempts of the given IP address.
+func (lt *loginThrottle) reset(ip string) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	delete(lt.failures, "ip "+ip)
+}
+
+// requestIP returns the IP address of the client, without the port.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isHTTPS returns whether the request was sent via TLS, either directly or to a reverse proxy.
+// Cookies of such requests get the Secure attribute.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+var (
+	protectionsMutex sync.Mutex
+	protections      = map[string]*Protection{} // All known protections by their key, used by the login page
+)
+
+// sessionKey is the key that session cookies are signed with.
+var sessionKey []byte
+
+// initSessionKey loads the key to sign session cookies with from the config.
+// If there is none, a random key is generated, which means that visitors have to log in again after every restart.
+func initSessionKey() {
+	var key string
+	if err := conf.Get(".Server.SessionKey", &key); err != nil || key == "" {
+		log.Warnf("Can't load session key from config files, using a random key. Visitors have to log in again after every restart: %v", err)
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			log.Fatalf("Couldn't generate random session key: %v", err)
+		}
+		return
+	}
+	sessionKey = []byte(key)
+}
+
+// newProtection returns a protection with the given password, and registers it for the login page.
+// The id has to identify the place where the protection is defined, e.g. a source or a folder.
+func newProtection(id, name, password string) *Protection {
+	hash := sha256.Sum256([]byte(id))
+	p := &Protection{key: hex.EncodeToString(hash[:8]), name: name, password: password}
+
+	protectionsMutex.Lock()
+	defer protectionsMutex.Unlock()
+	protections[p.key] = p
+
+	return p
+}
+
+// newLockedProtection returns a protection that can't be unlocked with any password.
+// It's used when it's not known whether an element is protected, e.g. because its manifest couldn't be read.
+func newLockedProtection(id, name string) *Protection {
+	hash := sha256.Sum256([]byte("locked " + id))
+	return &Protection{key: hex.EncodeToString(hash[:8]), name: name} // Not registered, so the login page doesn't know it
+}
+
+// protectionByKey returns the protection with the given key, or nil if there is none.
+func protectionByKey(key string) *Protection {
+	protectionsMutex.Lock()
+	defer protectionsMutex.Unlock()
+
+	return protections[key]
+}
+
+// signature returns the signature of a session that expires at the given time.
+// The password is part of the signature, so changing it ends all sessions.
+func (p *Protection) signature(expires int64) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(fmt.Sprintf("%s|%d|%s", p.key, expires, p.password)))
+	return mac.Sum(nil)
+}
+
+// sessionCookie returns a cookie that unlocks the protection.
+// The cookie is only sent via TLS if the request was sent via TLS.
+func (p *Protection) sessionCookie(r *http.Request) *http.Cookie {
+	expires := time.Now().Add(protectionSessionDuration)
+	return &http.Cookie{
+		Name:     protectionCookiePrefix + p.key,
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + hex.EncodeToString(p.signature(expires.Unix())),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// IsUnlocked returns whether the request contains a valid session cookie for the protection.
+func (p *Protection) IsUnlocked(r *http.Request) bool {
+	cookie, err := r.Cookie(protectionCookiePrefix + p.key)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	signature, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(signature, p.signature(expires))
+}
+
+// shareOnlyProtection is returned by lockedProtection for elements that can only be accessed via share links.
+// It's not registered, so it can't be unlocked on the login page.
+var shareOnlyProtection = &Protection{key: "share-only"}
+
+// lockedProtection returns the first protection of the element that the request hasn't unlocked, or nil if the element can be accessed.
+// Share links unlock all protections of the shared element.
+func lockedProtection(r *http.Request, e Element) *Protection {
+	policy := EffectiveAccessPolicy(e)
+	if len(policy.Protections) == 0 && !policy.ShareOnly || isShared(r, e) {
+		return nil
+	}
+	if policy.ShareOnly {
+		return shareOnlyProtection
+	}
+
+	for _, p := range policy.Protections {
+		if !p.IsUnlocked(r) {
+			return p
+		}
+	}
+	return nil
+}
+
+// uiRequireUnlocked checks whether the request may access the element, and returns true if it does.
+// Otherwise an error is sent, or the browser is redirected to the login page if redirect is set.
+func uiRequireUnlocked(w http.ResponseWriter, r *http.Request, e Element, redirect bool) bool {
+	p := lockedProtection(r, e)
+	if p == nil {
+		return true
+	}
+
+	// Don't reveal that there is anything without a valid share link
+	if p == shareOnlyProtection {
+		log.Errorf("(IP: %v): Access denied. Tried to access %v without share link", r.RemoteAddr, e)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return false
+	}
+
+	// Protections that can't be unlocked have no login page
+	if redirect && protectionByKey(p.key) == p {
+		http.Redirect(w, r, "/login?protection="+p.key+"&return="+url.QueryEscape(r.RequestURI), http.StatusFound)
+		return false
+	}
+
+	log.Errorf("(IP: %v): Access denied. Tried to access protected element %v", r.RemoteAddr, e)
+	http.Error(w, "This content is password protected", http.StatusUnauthorized)
+	return false
+}
+
+// setCacheControl sets the Cache-Control header for content of the element, so that it can be cached for the given number of seconds.
+// Content that can only be accessed with a session or share cookie must not be stored by shared caches, as these would send it to everyone.
+func setCacheControl(w http.ResponseWriter, e Element, maxAge int) {
+	policy := EffectiveAccessPolicy(e)
+	if len(policy.Protections) > 0 || policy.ShareOnly {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+		w.Header().Add("Vary", "Cookie")
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+}
+
+// hasOwnProtection returns whether the child element has a protection that its parent element doesn't have.
+func hasOwnProtection(parent, child Element) bool {
+	ep, ok := child.(ElementAccessPolicy)
+	if !ok {
+		return false
+	}
+
+	if ep.AccessPolicy().ShareOnly && !EffectiveAccessPolicy(parent).ShareOnly {
+		return true
+	}
+
+	parentProtections := map[string]bool{}
+	for _, p := range EffectiveAccessPolicy(parent).Protections {
+		parentProtections[p.key] = true
+	}
+	for _, p := range ep.AccessPolicy().Protections {
+		if !parentProtections[p.key] {
+			return true
+		}
+	}
+	return false
+}
+
+// folderManifestName is the name of the file that defines settings of a single folder of a folder source.
+const folderManifestName = ".galago.yaml"
+
+// folderManifest contains the settings of a single folder of a folder source.
+type folderManifest struct {
+	Password string `yaml:"Password"` // Protects the folder and everything inside of it
+}
+
+// readFolderManifest returns the manifest of the folder at the given path, or an empty manifest if there is none.
+func readFolderManifest(dirPath string) (folderManifest, error) {
+	var m folderManifest
+
+	data, err := ioutil.ReadFile(filepath.Join(dirPath, folderManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("Couldn't parse %q: %w", filepath.Join(dirPath, folderManifestName), err)
+	}
+
+	return m, nil
+}
+
+// uiSession gives templates access to the protections that the request has unlocked.
+type uiSession struct {
+	r *http.Request
+}
+
+// IsUnlocked returns whether the element can be accessed with the request.
+func (s uiSession) IsUnlocked(e Element) bool {
+	return lockedProtection(s.r, e) == nil
+}
+
+type uiLogin struct {
+	template *uiTemplate
+}
+
+func (t *uiLogin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Errorf("Invalid request. Couldn't parse form: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := protectionByKey(r.Form.Get("protection"))
+	if p == nil {
+		log.Errorf("Invalid request. Tried to log in with unknown protection %q", r.Form.Get("protection"))
+		http.Error(w, "Unknown protection", http.StatusBadRequest)
+		return
+	}
+
+	// Only allow local redirects
+	returnURL := r.Form.Get("return")
+	if !strings.HasPrefix(returnURL, "/") || strings.HasPrefix(returnURL, "//") || strings.HasPrefix(returnURL, "/\\") {
+		returnURL = "/"
+	}
+
+	failed := false
+	if r.Method == http.MethodPost {
+		ip := requestIP(r)
+		if !loginFailures.allow(ip, p.key) {
+			log.Warnf("(IP: %v): Too many failed login attempts for %q", r.RemoteAddr, p.name)
+			w.Header().Set("Retry-After", strconv.Itoa(int(loginFailureWindow.Seconds())))
+			http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("password")), []byte(p.password)) == 1 {
+			loginFailures.reset(ip)
+			http.SetCookie(w, p.sessionCookie(r))
+			http.Redirect(w, r, returnURL, http.StatusSeeOther)
+			log.Infof("(IP: %v): Logged in to %q", r.RemoteAddr, p.name)
+			return
+		}
+
+		log.Warnf("(IP: %v): Failed login attempt for %q", r.RemoteAddr, p.name)
+		loginFailures.fail(ip, p.key)
+		time.Sleep(protectionLoginDelay)
+		failed = true
+	}
+
+	tpl, err := t.template.Template()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d := struct {
+		Version                  *semver.Version
+		Name, Protection, Return string
+		Failed                   bool
+	}{
+		Version:    version,
+		Name:       p.name,
+		Protection: p.key,
+		Return:     returnURL,
+		Failed:     failed,
+	}
+
+	if failed {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if err := tpl.ExecuteTemplate(w, "base.gohtml", d); err != nil {
+		log.Errorf("Error executing template %q: %v", "base.gohtml", err)
+	}
+}
+
+type uiLogout struct{}
+
+func (t *uiLogout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, cookie := range r.Cookies() {
+		if strings.HasPrefix(cookie.Name, protectionCookiePrefix) {
+			http.SetCookie(w, &http.Cookie{Name: cookie.Name, Value: "", Path: "/", MaxAge: -1})
+		}
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	lt := &loginThrottle{failures: map[string]*loginFailureCount{}}
+
+	// Failures are limited per IP address
+	for i := 0; i < loginFailuresPerIP; i++ {
+		if !lt.allow("1.1.1.1", "album") {
+			t.Fatalf("Attempt was blocked after %d failures", i)
+		}
+		lt.fail("1.1.1.1", "album")
+	}
+	if lt.allow("1.1.1.1", "album") {
+		t.Errorf("Attempt was allowed after %d failures", loginFailuresPerIP)
+	}
+	if !lt.allow("2.2.2.2", "album") {
+		t.Error("Attempt from another IP address was blocked")
+	}
+
+	// A successful login resets the failures of its IP address
+	lt.reset("1.1.1.1")
+	if !lt.allow("1.1.1.1", "album") {
+		t.Error("Attempt was blocked after a successful login")
+	}
+
+	// Once a protection got too many failures, IP addresses that failed before are blocked, but new visitors can still log in
+	for i := 0; i < loginFailuresPerProtection; i++ {
+		lt.fail(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "album")
+	}
+	if lt.allow("10.0.0.1", "album") {
+		t.Error("Attempt from an IP address that failed before was allowed, although the protection got too many failures")
+	}
+	if !lt.allow("3.3.3.3", "album") {
+		t.Error("Attempt from a new IP address was blocked because of the failures of others")
+	}
+	if !lt.allow("10.0.0.1", "other-album") {
+		t.Error("Attempt for another protection was blocked")
+	}
+}
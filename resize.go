@@ -0,0 +1,161 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"runtime"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+// ReduceImage returns a version of the image that is scaled to the given height.
+//
+// Large images are first shrunk by halving them with a box filter, until they are less than twice as high as the target.
+// Only the remaining step is done with the Lanczos3 filter, which is a lot slower but has a better quality.
+// As the box filter averages all source pixels, this doesn't introduce any aliasing.
+// Halving stops at the first odd size, as the image content would be shifted otherwise.
+// Both steps run on all available CPU cores.
+func ReduceImage(img image.Image, height int) image.Image {
+	// The width is determined from the original aspect ratio, so it's the same with and without halving
+	bounds := img.Bounds()
+	width := int((int64(bounds.Dx())*int64(height)*2 + int64(bounds.Dy())) / (int64(bounds.Dy()) * 2))
+	if width < 1 {
+		width = 1
+	}
+
+	for img.Bounds().Dy()/2 >= height {
+		halved, ok := halveImage(img)
+		if !ok {
+			break
+		}
+		img = halved
+	}
+
+	if img.Bounds().Dx() == width && img.Bounds().Dy() == height {
+		return img
+	}
+
+	return resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+}
+
+// halveImage returns the image scaled to half its width and height, every resulting pixel is the average of 2x2 source pixels.
+//
+// The boolean is false if the type of the image isn't supported, or if the image can't be halved exactly because of an odd size.
+func halveImage(img image.Image) (image.Image, bool) {
+	bounds := img.Bounds()
+	if bounds.Dx()%2 != 0 || bounds.Dy()%2 != 0 {
+		return nil, false
+	}
+	rect := image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2)
+
+	switch src := img.(type) {
+	case *image.YCbCr:
+		// The chroma planes have to be halved exactly, too
+		dstCW, dstCH := ycbcrChromaSize(rect, src.SubsampleRatio)
+		srcCW, srcCH := ycbcrChromaSize(bounds, src.SubsampleRatio)
+		if srcCW != 2*dstCW || srcCH != 2*dstCH || bounds.Min.X%4 != 0 || bounds.Min.Y%2 != 0 {
+			return nil, false
+		}
+		dst := image.NewYCbCr(rect, src.SubsampleRatio)
+		halvePlane(dst.Y, dst.YStride, rect.Dx(), rect.Dy(), src.Y[src.YOffset(bounds.Min.X, bounds.Min.Y):], src.YStride, 1)
+		cOffset := src.COffset(bounds.Min.X, bounds.Min.Y)
+		halvePlane(dst.Cb, dst.CStride, dstCW, dstCH, src.Cb[cOffset:], src.CStride, 1)
+		halvePlane(dst.Cr, dst.CStride, dstCW, dstCH, src.Cr[cOffset:], src.CStride, 1)
+		return dst, true
+
+	case *image.Gray:
+		dst := image.NewGray(rect)
+		halvePlane(dst.Pix, dst.Stride, rect.Dx(), rect.Dy(), src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, 1)
+		return dst, true
+
+	case *image.RGBA:
+		dst := image.NewRGBA(rect)
+		halvePlane(dst.Pix, dst.Stride, rect.Dx(), rect.Dy(), src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, 4)
+		return dst, true
+
+	case *image.NRGBA:
+		dst := image.NewNRGBA(rect)
+		halvePlane(dst.Pix, dst.Stride, rect.Dx(), rect.Dy(), src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, 4)
+		return dst, true
+
+	case *image.CMYK:
+		dst := image.NewCMYK(rect)
+		halvePlane(dst.Pix, dst.Stride, rect.Dx(), rect.Dy(), src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, 4)
+		return dst, true
+	}
+
+	return nil, false
+}
+
+// ycbcrChromaSize returns the size of the chroma planes of a YCbCr image with the given bounds and subsample ratio.
+// This has to match the calculation in image.NewYCbCr.
+func ycbcrChromaSize(r image.Rectangle, subsampleRatio image.YCbCrSubsampleRatio) (w, h int) {
+	w, h = r.Dx(), r.Dy()
+	switch subsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		w = (r.Max.X+1)/2 - r.Min.X/2
+	case image.YCbCrSubsampleRatio420:
+		w = (r.Max.X+1)/2 - r.Min.X/2
+		h = (r.Max.Y+1)/2 - r.Min.Y/2
+	case image.YCbCrSubsampleRatio440:
+		h = (r.Max.Y+1)/2 - r.Min.Y/2
+	case image.YCbCrSubsampleRatio411:
+		w = (r.Max.X+3)/4 - r.Min.X/4
+	case image.YCbCrSubsampleRatio410:
+		w = (r.Max.X+3)/4 - r.Min.X/4
+		h = (r.Max.Y+1)/2 - r.Min.Y/2
+	}
+	return
+}
+
+// halvePlane writes the 2x2 box filtered version of the interleaved 8 bit src plane into dst.
+// src has to be exactly twice as wide and high as dst.
+// The rows are distributed over all CPU cores.
+func halvePlane(dst []uint8, dstStride, dstW, dstH int, src []uint8, srcStride, channels int) {
+	workers := runtime.GOMAXPROCS(0)
+	rowsPerWorker := (dstH + workers - 1) / workers
+
+	wg := sync.WaitGroup{}
+	for yStart := 0; yStart < dstH; yStart += rowsPerWorker {
+		yEnd := yStart + rowsPerWorker
+		if yEnd > dstH {
+			yEnd = dstH
+		}
+
+		wg.Add(1)
+		go func(yStart, yEnd int) {
+			defer wg.Done()
+
+			for y := yStart; y < yEnd; y++ {
+				row0, row1 := src[2*y*srcStride:], src[(2*y+1)*srcStride:]
+				dstRow := dst[y*dstStride:]
+
+				for x := 0; x < dstW; x++ {
+					sx0, sx1 := 2*x*channels, (2*x+1)*channels
+					for c := 0; c < channels; c++ {
+						sum := int(row0[sx0+c]) + int(row0[sx1+c]) + int(row1[sx0+c]) + int(row1[sx1+c])
+						dstRow[x*channels+c] = uint8((sum + 2) / 4)
+					}
+				}
+			}
+		}(yStart, yEnd)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+// psnr returns the peak signal-to-noise ratio in dB of 8 bit values with the given sum of squared errors.
+func psnr(sumSquaredError float64, n int) float64 {
+	if sumSquaredError == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255*float64(n)/sumSquaredError)
+}
+
+// imagePSNR returns the peak signal-to-noise ratio of the RGB channels of two images with the same size.
+func imagePSNR(a, b image.Image) float64 {
+	aBounds, bBounds := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < aBounds.Dy(); y++ {
+		for x := 0; x < aBounds.Dx(); x++ {
+			ar, ag, ab, _ := a.At(aBounds.Min.X+x, aBounds.Min.Y+y).RGBA()
+			br, bg, bb, _ := b.At(bBounds.Min.X+x, bBounds.Min.Y+y).RGBA()
+			for _, d := range []float64{float64(ar>>8) - float64(br>>8), float64(ag>>8) - float64(bg>>8), float64(ab>>8) - float64(bb>>8)} {
+				sum += d * d
+			}
+		}
+	}
+	return psnr(sum, aBounds.Dx()*aBounds.Dy()*3)
+}
+
+// lumaPSNR returns the peak signal-to-noise ratio of the luma of two images with the same size.
+func lumaPSNR(a, b image.Image) float64 {
+	aBounds, bBounds := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < aBounds.Dy(); y++ {
+		for x := 0; x < aBounds.Dx(); x++ {
+			aGray := color.GrayModel.Convert(a.At(aBounds.Min.X+x, aBounds.Min.Y+y)).(color.Gray)
+			bGray := color.GrayModel.Convert(b.At(bBounds.Min.X+x, bBounds.Min.Y+y)).(color.Gray)
+			d := float64(aGray.Y) - float64(bGray.Y)
+			sum += d * d
+		}
+	}
+	return psnr(sum, aBounds.Dx()*aBounds.Dy())
+}
+
+// testPatternImage returns an image with gradients and waves of different frequencies.
+func testPatternImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x), float64(y)
+			img.Set(x, y, color.RGBA{
+				uint8(128 + 60*math.Sin(fx/13) + 60*math.Cos(fy/29)),
+				uint8(fx * 255 / float64(width)),
+				uint8(128 + 100*math.Sin((fx+fy)/41)),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+func TestReduceImageMatchesLanczos(t *testing.T) {
+	const minPSNR = 35
+
+	rgba := testPatternImage(1024, 768)
+
+	gray := image.NewGray(rgba.Bounds())
+	ycbcr444 := image.NewYCbCr(rgba.Bounds(), image.YCbCrSubsampleRatio444)
+	for y := 0; y < 768; y++ {
+		for x := 0; x < 1024; x++ {
+			gray.Set(x, y, rgba.At(x, y))
+			c := rgba.RGBAAt(x, y)
+			ycbcr444.Y[ycbcr444.YOffset(x, y)], ycbcr444.Cb[ycbcr444.COffset(x, y)], ycbcr444.Cr[ycbcr444.COffset(x, y)] = color.RGBToYCbCr(c.R, c.G, c.B)
+		}
+	}
+
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, rgba, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	ycbcr420, err := jpeg.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reduced versions of subsampled images keep their subsampled chroma, while the reference has full resolution chroma.
+	// Therefore only their luma is compared
+	images := map[string]struct {
+		img     image.Image
+		compare func(a, b image.Image) float64
+	}{
+		"RGBA":     {rgba, imagePSNR},
+		"Gray":     {gray, imagePSNR},
+		"YCbCr444": {ycbcr444, imagePSNR},
+		"YCbCr420": {ycbcr420, lumaPSNR},
+		"SubImage": {rgba.SubImage(image.Rect(100, 76, 900, 676)), imagePSNR},
+		"OddSize":  {testPatternImage(1001, 777), imagePSNR},
+	}
+
+	for name, test := range images {
+		img := test.img
+		for _, height := range []int{90, 96, 240} {
+			reduced := ReduceImage(img, height)
+			width := reduced.Bounds().Dx()
+			if reduced.Bounds().Dy() != height {
+				t.Errorf("%s: Got height %d, want %d", name, reduced.Bounds().Dy(), height)
+				continue
+			}
+
+			reference := resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+			if reference.Bounds().Dx() != width {
+				t.Errorf("%s: Got width %d for height %d, Lanczos3 resize gives %d", name, width, height, reference.Bounds().Dx())
+				continue
+			}
+			if p := test.compare(reduced, reference); p < minPSNR {
+				t.Errorf("%s: PSNR of image reduced to height %d compared to Lanczos3 is %.1f dB, want at least %v dB", name, height, p, minPSNR)
+			}
+		}
+	}
+}
@@ -18,15 +18,17 @@
 package main
 
 import (
-	"archive/zip"
-	"compress/flate"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
@@ -37,7 +39,9 @@ var templateFuncmap = template.FuncMap{
 	"filterImages":     FilterImages,
 	"filterNonEmpty":   FilterNonEmpty,
 	"filterContainers": FilterContainers,
-	"imageToDataURI":   ImageToDataURI,
+	"imagePlaceholder": ImagePlaceholder,
+	"imageSrcSet":      ImageSrcSet,
+	"accessPolicy":     EffectiveAccessPolicy,
 	"previousElement":  PreviousElement,
 	"nextElement":      NextElement,
 	"getPreviewImages": GetPreviewImages,
@@ -100,14 +104,21 @@ func (t *uiTemplate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Send visitors to the login page if the element is password protected
+	if element, err := RootElement.Traverse(r.URL.Path); err == nil && !uiRequireUnlocked(w, r, element, true) {
+		return
+	}
+
 	d := struct {
 		RootElement *Album
 		Version     *semver.Version
 		Path        string
+		Session     uiSession
 	}{
 		RootElement: RootElement,
 		Version:     version,
 		Path:        r.URL.Path,
+		Session:     uiSession{r},
 	}
 
 	if err := tpl.ExecuteTemplate(w, "base.gohtml", d); err != nil {
@@ -140,7 +151,18 @@ func (t *uiImage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imageFile, size, mime, err := image.FileContent()
+	if !uiRequireUnlocked(w, r, element, false) {
+		return
+	}
+
+	if EffectiveAccessPolicy(element).NoOriginals {
+		log.Errorf("Access denied. Tried to access original image %v", element)
+		http.Error(w, "Access to the original image is not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Originals are sent like downloads, so metadata is removed the same way
+	file, imageFile, err := newDownloadFile(image, element.URLName(), "original")
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -148,11 +170,11 @@ func (t *uiImage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer imageFile.Close()
 
-	w.Header().Set("Content-Type", mime)
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-	w.Header().Set("Cache-Control", "public, max-age=86400") // 1 Day
+	w.Header().Set("Content-Type", file.mime)
+	setCacheControl(w, element, 86400) // 1 Day
+	w.Header().Set("ETag", `"`+file.etag+`"`)
 
-	io.Copy(w, imageFile)
+	serveContent(w, r, imageFile, file.size, file.modTime)
 
 	log.Tracef("(IP: %v): Served original image %v in %v µs", r.RemoteAddr, element.Name(), time.Now().Sub(timeStart).Microseconds())
 }
@@ -161,7 +183,10 @@ type uiCachedImage struct{}
 
 func (t *uiCachedImage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	timeStart := time.Now()
-	hash := r.URL.Path
+
+	// The path is either {hash} or {hash}/{height}
+	pathElements := strings.SplitN(r.URL.Path, "/", 2)
+	hash, height := pathElements[0], defaultRenditionHeight
 
 	// Make sure only alphanumeric hashes can be queried
 	if !isAlphanumeric(hash) {
@@ -170,14 +195,51 @@ func (t *uiCachedImage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ce, err := cache.QueryCacheEntryHash(hash)
+	if len(pathElements) > 1 {
+		var err error
+		if height, err = strconv.Atoi(pathElements[1]); err != nil || height <= 0 {
+			log.Errorf("Invalid request. Tried to query cache element with height %q", pathElements[1])
+			http.Error(w, "The height has to be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The image is needed to check whether the visitor is allowed to see it.
+	// Only images that are already known to the cache are served, see Cache.IndexImages.
+	// The image may be reachable via several paths, e.g. via tags or combine sources, it can be accessed if any of them is unlocked
+	var element Element
+	for _, path := range cache.ImagePaths(hash) {
+		if e, ok := imageByPath(path, hash).(Element); ok {
+			element = e
+			if lockedProtection(r, e) == nil {
+				break
+			}
+		}
+	}
+	if element == nil {
+		log.Errorf("Couldn't find image with hash %q", hash)
+		http.Error(w, "Couldn't find an image with the given hash", http.StatusNotFound)
+		return
+	}
+	if !uiRequireUnlocked(w, r, element, false) {
+		return
+	}
+
+	// Evicted cache entries are regenerated here
+	ce, err := cache.QueryCompleteCacheEntryHash(hash)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	f, size, mime, err := ce.ReducedImage()
+	// Serve the smallest format the browser supports, see CacheEntry.ReducedImage
+	formats := []string{}
+	if accept := r.Header.Get("Accept"); strings.Contains(accept, "image/webp") {
+		formats = append(formats, "webp")
+	}
+
+	f, info, mime, err := ce.ReducedImage(height, formats)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -186,10 +248,11 @@ func (t *uiCachedImage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer f.Close()
 
 	w.Header().Set("Content-Type", mime)
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-	w.Header().Set("Cache-Control", "public, max-age=2419200") // 4 weeks
+	w.Header().Set("Vary", "Accept")
+	setCacheControl(w, element, 2419200)      // 4 weeks
+	w.Header().Set("ETag", `"`+info.Name+`"`) // The file name contains the hash, the height and the format
 
-	io.Copy(w, f)
+	serveContent(w, r, f, info.Size, info.ModTime)
 
 	log.Tracef("(IP: %v): Sent reduced image %q in %v µs", r.RemoteAddr, r.URL.Path, time.Now().Sub(timeStart).Microseconds())
 }
@@ -205,92 +268,235 @@ func (t *uiDownload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The size of the downloaded images, see downloadSizes
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "original"
+	}
+	if _, ok := downloadSizes[size]; !ok {
+		log.Errorf("Invalid request. Tried to download with size %q", size)
+		http.Error(w, fmt.Sprintf("Unknown size %q", size), http.StatusBadRequest)
+		return
+	}
+
+	if !uiRequireUnlocked(w, r, element, false) {
+		return
+	}
+
+	policy := EffectiveAccessPolicy(element)
+
 	// Handle download of single image files
 	if img, ok := element.(Image); ok {
-		re, size, mime, err := img.FileContent()
-		if err != nil {
+		if !policy.AllowsDownload(size, false) {
+			log.Errorf("Access denied. Tried to download image %v in size %q", element, size)
+			http.Error(w, "Downloading this image in this size is not allowed", http.StatusForbidden)
+			return
+		}
+
+		file, re, err := newDownloadFile(img, element.URLName(), size)
+		if errors.Is(err, errDownloadNotAllowed) {
+			log.Errorf("Access denied. %v", err)
+			http.Error(w, "Downloading this image in this size is not possible", http.StatusForbidden)
+			return
+		} else if err != nil {
 			log.Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer re.Close()
 
-		w.Header().Set("Content-Disposition", "attachment; filename="+element.URLName())
-		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-		w.Header().Set("Content-Type", mime)
+		w.Header().Set("Content-Disposition", "attachment; filename="+file.name)
+		w.Header().Set("Content-Type", file.mime)
+		w.Header().Set("ETag", `"`+file.etag+`"`)
 
-		io.Copy(w, re)
+		serveContent(w, r, re, file.size, file.modTime)
 
-		log.Tracef("(IP: %v): Sent archived image %q in %v µs", r.RemoteAddr, element.Name(), time.Now().Sub(timeStart).Microseconds())
+		log.Tracef("(IP: %v): Sent image %q in size %q in %v µs", r.RemoteAddr, element.Name(), size, time.Now().Sub(timeStart).Microseconds())
 		return
 	}
 
-	// Handle download of containers. This will pack all images contained in element into an archive and stream it to the browser.
-	if element.IsContainer() {
-		w.Header().Set("Content-Disposition", "attachment; filename="+element.Name()+".zip")
-		w.Header().Set("Content-Type", "application/zip")
-
-		zw := zip.NewWriter(w)
+	if !element.IsContainer() {
+		log.Tracef("(IP: %v): Requested file is neither an image nor any other supported element", r.RemoteAddr)
+		http.Error(w, "Requested file is neither an image nor any other supported element.", http.StatusBadRequest)
+		return
+	}
 
-		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-			return flate.NewWriter(out, flate.NoCompression)
-		})
+	if policy.NoZipDownload {
+		log.Errorf("Access denied. Tried to download archive of %v", element)
+		http.Error(w, "Downloading this album is not allowed", http.StatusForbidden)
+		return
+	}
 
-		children, err := element.Children()
-		if err != nil {
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	var entries []downloadEntry
+	if r.Method == http.MethodPost {
+		// Handle download of a selection of images inside of a container.
+		// The images are given as paths relative to the container
+		if err := r.ParseForm(); err != nil {
+			log.Errorf("Invalid request. Couldn't parse form: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		for _, child := range children {
-			if cImg, ok := child.(Image); ok {
-				cw, err := zw.Create(child.URLName())
-				if err != nil {
-					log.Error(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				cr, _, _, err := cImg.FileContent()
-				if err != nil {
-					log.Error(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				defer cr.Close()
-
-				if _, err := io.Copy(cw, cr); err != nil {
-					log.Error(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		// Validate the whole selection before anything is sent.
+		// Paths are traversed from the container, so it's not possible to reach anything outside of it
+		selected := map[string]bool{}
+		for _, path := range r.PostForm["image"] {
+			child, err := TraverseElements(element, path)
+			if err != nil {
+				log.Errorf("Invalid request. Couldn't find selected element %q in %v: %v", path, element, err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
+			img, ok := child.(Image)
+			if !ok {
+				log.Errorf("Invalid request. Selected element %v is not an image", child)
+				http.Error(w, fmt.Sprintf("Selected element %q is not an image", path), http.StatusBadRequest)
+				return
+			}
+			if !uiRequireUnlocked(w, r, child, false) {
+				return
+			}
+			if !EffectiveAccessPolicy(child).AllowsDownload(size, true) {
+				log.Errorf("Access denied. Tried to download selected image %v in size %q", child, size)
+				http.Error(w, fmt.Sprintf("Downloading %q in this size is not allowed", path), http.StatusForbidden)
+				return
+			}
+
+			// The name inside of the archive is built from the resolved element, as the given path may be written differently, e.g. with a trailing slash
+			name := strings.TrimPrefix(child.Path(), element.Path()+"/")
+			if selected[name] {
+				continue
+			}
+			selected[name] = true
+			entries = append(entries, downloadEntry{img: img, name: name})
+		}
+		if len(entries) == 0 {
+			log.Errorf("Invalid request. No images selected for download of %v", element)
+			http.Error(w, "No images selected", http.StatusBadRequest)
+			return
 		}
 
-		if err := zw.Close(); err != nil {
+	} else {
+		// Handle download of containers. This will pack all images contained in element into an archive.
+		// With the recursive query parameter set, all nested albums are included as directories
+		recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive"))
+		// Images that can't be archived in the given size and albums that are locked are left out
+		include := func(e Element) bool {
+			if lockedProtection(r, e) != nil {
+				return false
+			}
+			return e.IsContainer() || EffectiveAccessPolicy(e).AllowsDownload(size, true)
+		}
+		if entries, err = collectDownloadEntries(element, "", recursive, include); err != nil {
 			log.Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+	}
+
+	// Stream the archive to the browser.
+	// The size of the archive is only known if none of the images has to be processed, otherwise it's sent without content length
+	w.Header().Set("Content-Disposition", "attachment; filename="+element.Name()+".zip")
+	w.Header().Set("Content-Type", "application/zip")
+	archiveSize, expected, ok := zipSize(entries, size)
+	if ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(archiveSize, 10))
+	}
+
+	// Once the archive is being streamed, errors can't be sent to the browser anymore.
+	// The archive will just be incomplete
+	if err := writeZip(w, entries, size, expected); err != nil {
+		log.Errorf("Couldn't write archive of %v: %v", element, err)
+		return
+	}
+
+	log.Tracef("(IP: %v): Sent %v archived images of %q in size %q in %v µs", r.RemoteAddr, len(entries), element.Name(), size, time.Now().Sub(timeStart).Microseconds())
+}
+
+// serveContent sends the given content.
+// Conditional and range requests are supported if the content is seekable, the ETag header has to be set beforehand.
+func serveContent(w http.ResponseWriter, r *http.Request, content io.Reader, size int64, modTime time.Time) {
+	if rs, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", modTime, rs)
+		return
+	}
+
+	w.Header().Del("ETag") // Without support for conditional requests the ETag is of no use
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, content)
+}
 
-		log.Tracef("(IP: %v): Sent %v archived images of %q in %v µs", r.RemoteAddr, len(children), element.Name(), time.Now().Sub(timeStart).Microseconds())
+// imageModTime returns the modification time of the original image file, or the zero time if it's not known.
+func imageModTime(img Image) time.Time {
+	if i, ok := img.(ImageModTime); ok {
+		return i.ModTime()
+	}
+	return time.Time{}
+}
+
+type uiPermalink struct{}
+
+func (t *uiPermalink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Path
+
+	// Make sure only alphanumeric hashes can be queried
+	if !isAlphanumeric(hash) {
+		log.Errorf("Invalid request. Tried to query permalink with hash %q", hash)
+		http.Error(w, "The hash can only be alphanumeric", http.StatusBadRequest)
 		return
 	}
 
-	log.Tracef("(IP: %v): Requested file is neither an image nor any other supported element", r.RemoteAddr)
-	http.Error(w, "Requested file is neither an image nor any other supported element.", http.StatusBadRequest)
+	// Only redirect to paths that the visitor could find anyway.
+	// Otherwise permalinks would reveal the paths of hidden or protected albums
+	var element Element
+	for _, path := range cache.ImagePaths(hash) {
+		if e, ok := imageByPath(path, hash).(Element); ok && lockedProtection(r, e) == nil && (!IsHiddenPath(e) || isShared(r, e)) {
+			element = e
+			break
+		}
+	}
+	if element == nil {
+		log.Errorf("(IP: %v): Couldn't find accessible image with hash %q", r.RemoteAddr, hash)
+		http.Error(w, "Couldn't find an image with the given hash", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, (&url.URL{Path: "/image-viewer" + element.Path()}).String(), http.StatusFound)
+}
+
+// uiCacheStatus writes statistics of the cache as JSON.
+type uiCacheStatus struct{}
+
+func (t *uiCacheStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	status := struct {
+		Memory CacheMemoryStats `json:"memory"`
+	}{
+		Memory: cache.MemoryStats(),
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("Couldn't encode cache status: %v", err)
+	}
 }
 
 func serverUIInit() {
+	router.Use(countActiveRequests)
+
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join(".", "ui", "static")))))
 
-	//router.Handle("/login", auth.LoginHandler(storage.StorageSessions, storage.StorageUsers))
-	//router.Handle("/logout", auth.LogoutHandler(storage.StorageSessions))
+	router.Handle("/login", &uiLogin{template: newUITemplate("login.gohtml")})
+	router.Handle("/logout", &uiLogout{})
+	router.PathPrefix("/share/").Handler(http.StripPrefix("/share/", &uiShare{}))
 
 	router.PathPrefix("/image/").Handler(http.StripPrefix("/image/", &uiImage{}))
 	router.PathPrefix("/cached/").Handler(http.StripPrefix("/cached/", &uiCachedImage{}))
 	router.PathPrefix("/download/").Handler(http.StripPrefix("/download/", &uiDownload{}))
+	router.PathPrefix("/permalink/").Handler(http.StripPrefix("/permalink/", &uiPermalink{}))
+	router.Handle("/status/cache-warmup", cacheWarmer)
+	router.Handle("/status/cache", &uiCacheStatus{})
 
 	router.Handle("/", http.StripPrefix("/", newUITemplate("gallery.gohtml")))
 	router.PathPrefix("/gallery/").Handler(http.StripPrefix("/gallery/", newUITemplate("gallery.gohtml")))
@@ -0,0 +1,242 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/configdb/tree"
+)
+
+// writeTestJPEG writes a JPEG image with a gradient to the given path.
+func writeTestJPEG(t *testing.T, path string, width, height int) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useTestCache replaces the global cache with an empty one for the duration of the test.
+func useTestCache(t *testing.T, options CacheOptions) *Cache {
+	t.Helper()
+
+	c, err := NewCache(t.TempDir(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCache, oldRoot := cache, RootElement
+	t.Cleanup(func() { cache, RootElement = oldCache, oldRoot })
+	cache = c
+
+	return c
+}
+
+// loadTestSource replaces the global root element with one that contains a single folder source with the given configuration.
+func loadTestSource(t *testing.T, urlName string, c tree.Node) {
+	t.Helper()
+
+	root := &Album{}
+	source, err := CreateSourceFolder(root, 0, urlName, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.children = append(root.children, source)
+	RootElement = root
+}
+
+func TestCachedImageAccessFollowsReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "image.jpg"), 64, 48)
+	useTestCache(t, CacheOptions{RenditionHeights: []int{32}})
+
+	// Query the image of the unprotected source, so it's known to the cache
+	loadTestSource(t, "test", tree.Node{"Name": "Test", "Type": "folder", "Path": dir})
+	element, err := RootElement.Traverse("test/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := element.(Image)
+	if _, err := img.CacheEntry(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(hash string) int {
+		rec := httptest.NewRecorder()
+		http.StripPrefix("/cached/", &uiCachedImage{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cached/"+hash+"/32", nil))
+		return rec.Code
+	}
+
+	if code := get(img.Hash()); code != http.StatusOK {
+		t.Fatalf("Got status %v for unprotected image, want %v", code, http.StatusOK)
+	}
+
+	// Reload the source with a password, the hash of the image stays the same
+	loadTestSource(t, "test", tree.Node{"Name": "Test", "Type": "folder", "Path": dir, "Password": "secret"})
+	if code := get(img.Hash()); code != http.StatusUnauthorized {
+		t.Errorf("Got status %v for image of reloaded protected source, want %v", code, http.StatusUnauthorized)
+	}
+
+	// Unknown hashes are not searched for
+	if code := get("0123456789abcdef"); code != http.StatusNotFound {
+		t.Errorf("Got status %v for unknown hash, want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	data, scans := testMetadataJPEG(t)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Stripped files are concatenated from the rewritten header and the original file, ranges may span both
+	stripped, strippedSize, err := StripMetadata(testReaderAtCloser{bytes.NewReader(data)}, int64(len(data)), "image/jpeg", MetadataPolicy{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strippedData, err := ioutil.ReadAll(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := map[string]func() (io.Reader, []byte){
+		"plain":    func() (io.Reader, []byte) { return bytes.NewReader(data), data },
+		"stripped": func() (io.Reader, []byte) { return stripped, strippedData },
+	}
+
+	for name, content := range contents {
+		serve := func(header http.Header) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for key, values := range header {
+				r.Header[key] = values
+			}
+			rec := httptest.NewRecorder()
+			rec.Header().Set("ETag", `"test"`)
+			c, expected := content()
+			serveContent(rec, r, c, int64(len(expected)), modTime)
+			return rec
+		}
+		_, expected := content()
+
+		if rec := serve(nil); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), expected) {
+			t.Errorf("%s: Got status %v and %d bytes, want %v and %d bytes", name, rec.Code, rec.Body.Len(), http.StatusOK, len(expected))
+		}
+
+		if rec := serve(http.Header{"If-None-Match": {`"test"`}}); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("%s: Got status %v and %d bytes for matching ETag, want %v", name, rec.Code, rec.Body.Len(), http.StatusNotModified)
+		}
+
+		if rec := serve(http.Header{"If-Modified-Since": {modTime.Format(http.TimeFormat)}}); rec.Code != http.StatusNotModified {
+			t.Errorf("%s: Got status %v for unmodified content, want %v", name, rec.Code, http.StatusNotModified)
+		}
+
+		if rec := serve(http.Header{"If-Modified-Since": {modTime.Add(-time.Hour).Format(http.TimeFormat)}}); rec.Code != http.StatusOK {
+			t.Errorf("%s: Got status %v for modified content, want %v", name, rec.Code, http.StatusOK)
+		}
+
+		// The range starts in front of the first scan, which is where the header of stripped files ends
+		first, last := len(expected)-len(scans)-50, len(expected)-len(scans)+49
+		rec := serve(http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", first, last)}})
+		if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), expected[first:last+1]) {
+			t.Errorf("%s: Got status %v and %d bytes for range, want %v and 100 bytes", name, rec.Code, rec.Body.Len(), http.StatusPartialContent)
+		}
+		if contentRange, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", first, last, len(expected)); contentRange != want {
+			t.Errorf("%s: Got Content-Range %q, want %q", name, contentRange, want)
+		}
+	}
+	if int64(len(strippedData)) != strippedSize {
+		t.Errorf("Stripped file has %d bytes, but the returned size is %d", len(strippedData), strippedSize)
+	}
+
+	// Content that isn't seekable is always sent completely
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"test"`)
+	r.Header.Set("Range", "bytes=10-299")
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", `"test"`)
+	serveContent(rec, r, io.MultiReader(bytes.NewReader(data)), int64(len(data)), modTime)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) || rec.Header().Get("ETag") != "" {
+		t.Errorf("Got status %v, %d bytes and ETag %q for content that isn't seekable, want %v, %d bytes and no ETag", rec.Code, rec.Body.Len(), rec.Header().Get("ETag"), http.StatusOK, len(data))
+	}
+}
+
+func TestDownloadArchiveContentLength(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "a.jpg"), 64, 48)
+	writeTestJPEG(t, filepath.Join(dir, "b.jpg"), 32, 24)
+	useTestCache(t, CacheOptions{RenditionHeights: []int{1080}})
+
+	download := func(size string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		http.StripPrefix("/download/", &uiDownload{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/test?size="+size, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Got status %v for archive in size %q, want %v", rec.Code, size, http.StatusOK)
+		}
+		if _, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len())); err != nil {
+			t.Errorf("Archive in size %q is invalid: %v", size, err)
+		}
+		return rec
+	}
+
+	// Originals without any processing have a known size
+	loadTestSource(t, "test", tree.Node{"Name": "Test", "Type": "folder", "Path": dir})
+	rec := download("original")
+	if length := rec.Header().Get("Content-Length"); length != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Got Content-Length %q for archive of originals with %d bytes", length, rec.Body.Len())
+	}
+
+	// Reduced versions are only known once they are in the cache
+	if length := download("web").Header().Get("Content-Length"); length != "" {
+		t.Errorf("Got Content-Length %q for archive of images that aren't in the cache yet", length)
+	}
+	rec = download("web")
+	if length := rec.Header().Get("Content-Length"); length != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Got Content-Length %q for archive of cached images with %d bytes", length, rec.Body.Len())
+	}
+
+	// Originals whose metadata is removed are processed while the archive is streamed
+	loadTestSource(t, "test", tree.Node{"Name": "Test", "Type": "folder", "Path": dir, "StripMetadata": "all"})
+	if length := download("original").Header().Get("Content-Length"); length != "" {
+		t.Errorf("Got Content-Length %q for archive of processed originals", length)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand("share", "Print a link that grants access to an album or image until it expires. Use -expires to set the duration and -url to set the address of the server", func(args []string) error {
+		flags := flag.NewFlagSet("share", flag.ContinueOnError)
+		expires := flags.Duration("expires", 7*24*time.Hour, "Duration after which the link stops working")
+		baseURL := flags.String("url", "", "Address of the server, e.g. https://example.com")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Expected the path of exactly one element, e.g. /examples/cats")
+		}
+
+		element, err := RootElement.Traverse(strings.Trim(flags.Arg(0), "/"))
+		if err != nil {
+			return fmt.Errorf("Couldn't find element %q: %w", flags.Arg(0), err)
+		}
+
+		share := Share{Path: element.Path(), Expires: time.Now().Add(*expires)}
+		token, err := share.Token()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Link to %q, valid until %v:\n", share.Path, share.Expires.Format(time.RFC3339))
+		fmt.Printf("%v/share/%v\n", strings.TrimSuffix(*baseURL, "/"), token)
+		fmt.Printf("To revoke it, add %q to Server.RevokedShares\n", share.ID())
+		return nil
+	})
+}
+
+// shareCookiePrefix is the prefix of the names of cookies that contain share links.
+const shareCookiePrefix = "galago-share-"
+
+// Share grants access to an element and everything inside of it, even if it's hidden or password protected.
+//
+// Shares are not stored anywhere.
+// Their tokens are signed with the key from Server.ShareKey, so all shares can be revoked by changing the key.
+// Single shares can be revoked by adding their ID to Server.RevokedShares.
+type Share struct {
+	Path    string    // Absolute path of the shared element
+	Expires time.Time // Time after which the share isn't valid anymore
+}
+
+// shareKey returns the key that shares are signed with.
+// The config is read every time, so changes to the key take effect immediately.
+func shareKey() ([]byte, error) {
+	var key string
+	if err := conf.Get(".Server.ShareKey", &key); err != nil {
+		return nil, fmt.Errorf("Share links are disabled, as there is no Server.ShareKey in the config files: %w", err)
+	}
+	if key == "" {
+		return nil, errors.New("Share links are disabled, as Server.ShareKey is empty")
+	}
+	return []byte(key), nil
+}
+
+// signature returns the signature of the share, or an error if there is no key.
+func (s Share) signature() ([]byte, error) {
+	key, err := shareKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s.payload()))
+	return mac.Sum(nil)[:16], nil
+}
+
+// payload returns the signed part of the token.
+func (s Share) payload() string {
+	return s.Path + "\n" + strconv.FormatInt(s.Expires.Unix(), 10)
+}
+
+// Token returns the string that is used in share links.
+func (s Share) Token() (string, error) {
+	signature, err := s.signature()
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(s.payload())) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ID returns the identifier that is used to revoke the share.
+// It doesn't depend on the key, so it stays the same when the key is changed.
+func (s Share) ID() string {
+	hash := sha256.Sum256([]byte(s.payload()))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Covers returns whether the share grants access to the given element.
+func (s Share) Covers(e Element) bool {
+	path := e.Path()
+	return path == s.Path || strings.HasPrefix(path, s.Path+"/")
+}
+
+// ParseShare returns the share of the given token, if the token is valid.
+// Tokens with a wrong signature, expired shares and revoked shares are not valid.
+func ParseShare(token string) (Share, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return Share{}, errors.New("Malformed share token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Share{}, fmt.Errorf("Malformed share token: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Share{}, fmt.Errorf("Malformed share token: %w", err)
+	}
+
+	fields := strings.SplitN(string(payload), "\n", 2)
+	if len(fields) != 2 {
+		return Share{}, errors.New("Malformed share token")
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Share{}, fmt.Errorf("Malformed share token: %w", err)
+	}
+	s := Share{Path: fields[0], Expires: time.Unix(expires, 0)}
+
+	expected, err := s.signature()
+	if err != nil {
+		return Share{}, err
+	}
+	if !hmac.Equal(signature, expected) {
+		return Share{}, errors.New("Invalid share signature")
+	}
+
+	if time.Now().After(s.Expires) {
+		return Share{}, fmt.Errorf("Share expired at %v", s.Expires.Format(time.RFC3339))
+	}
+
+	var revoked []string
+	conf.Get(".Server.RevokedShares", &revoked) // Optional, no share is revoked if not set
+	for _, id := range revoked {
+		if id == s.ID() {
+			return Share{}, fmt.Errorf("Share %q has been revoked", id)
+		}
+	}
+
+	return s, nil
+}
+
+// requestShares returns all valid shares stored in the cookies of the request.
+func requestShares(r *http.Request) []Share {
+	shares := []Share{}
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, shareCookiePrefix) {
+			continue
+		}
+		if s, err := ParseShare(cookie.Value); err == nil {
+			shares = append(shares, s)
+		}
+	}
+	return shares
+}
+
+// isShared returns whether the request contains a valid share for the element.
+func isShared(r *http.Request, e Element) bool {
+	for _, s := range requestShares(r) {
+		if s.Covers(e) {
+			return true
+		}
+	}
+	return false
+}
+
+type uiShare struct{}
+
+func (t *uiShare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Path
+
+	s, err := ParseShare(token)
+	if err != nil {
+		log.Errorf("(IP: %v): Invalid share link: %v", r.RemoteAddr, err)
+		http.Error(w, "This link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	element, err := RootElement.Traverse(strings.TrimPrefix(s.Path, "/"))
+	if err != nil {
+		log.Errorf("Couldn't find shared element %q: %v", s.Path, err)
+		http.Error(w, "The shared element doesn't exist anymore", http.StatusNotFound)
+		return
+	}
+
+	// The share is stored in a cookie, so it also applies to the images and downloads of the element
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookiePrefix + s.ID(),
+		Value:    token,
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	target := "/image-viewer" + element.Path()
+	if element.IsContainer() {
+		target = "/gallery" + element.Path() + "/"
+	}
+	http.Redirect(w, r, (&url.URL{Path: target}).String(), http.StatusFound)
+
+	log.Infof("(IP: %v): Opened share link of %q", r.RemoteAddr, s.Path)
+}
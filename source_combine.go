@@ -36,11 +36,13 @@ type SourceCombine struct {
 	internalPaths []string
 	hidden        bool
 	home          bool
+	access        AccessPolicy
 	sourceTags    *SourceTags
 }
 
 // Compile time check if SourceCombine implements Element.
 var _ Element = (*SourceCombine)(nil)
+var _ ElementAccessPolicy = (*SourceCombine)(nil)
 
 // CreateSourceCombine returns a new instance of the source.
 func CreateSourceCombine(parent Element, index int, urlName string, c tree.Node) (Element, error) {
@@ -65,6 +67,7 @@ func CreateSourceCombine(parent Element, index int, urlName string, c tree.Node)
 		internalPaths: paths,
 		hidden:        hidden,
 		home:          home,
+		access:        ParseAccessPolicy(c, urlName, name),
 	}
 
 	// Add tags source pointing towards the source folder itself
@@ -131,12 +134,21 @@ func (s *SourceCombine) Children() ([]Element, error) {
 			continue
 		}
 
-		elements = append(elements, element.Clone(s, len(elements)))
+		elements = append(elements, cloneWithAccessPolicy(element, s, len(elements)))
 	}
 
 	return elements, nil
 }
 
+// AccessPolicy returns the access policy of the element itself.
+func (s *SourceCombine) AccessPolicy() AccessPolicy {
+	return s.access
+}
+
+func (s *SourceCombine) inheritAccessPolicy(p AccessPolicy) {
+	s.access = s.access.Merge(p)
+}
+
 // Path returns the absolute path of the element, but not the filesystem path.
 // For details see ElementPath.
 func (s *SourceCombine) Path() string {
@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/Dadido3/configdb/tree"
 )
@@ -42,11 +43,16 @@ type SourceFolder struct {
 	filePath      string
 	hidden        bool
 	home          bool
+	contentHash   bool           // Derive the hash of images from their content instead of their path and modification time
+	stripMetadata MetadataPolicy // Metadata that is removed from original images before they are sent
+	watermark     *Watermark     // Watermark that is drawn over the images, or nil
+	access        AccessPolicy
 	sourceTags    *SourceTags
 }
 
 // Compile time check if SourceFolder implements Element.
 var _ Element = (*SourceFolder)(nil)
+var _ ElementAccessPolicy = (*SourceFolder)(nil)
 
 // CreateSourceFolder returns a new instance of a folder source.
 func CreateSourceFolder(parent Element, index int, urlName string, c tree.Node) (Element, error) {
@@ -63,14 +69,39 @@ func CreateSourceFolder(parent Element, index int, urlName string, c tree.Node)
 		return nil, fmt.Errorf("Configuration of source %q errornous: %w", urlName, err)
 	}
 
+	contentHash := false
+	if hashing, ok := c["Hashing"].(string); ok {
+		switch hashing {
+		case "path":
+		case "content":
+			contentHash = true
+		default:
+			return nil, fmt.Errorf("Configuration of source %q errornous: Unknown hashing method %q", urlName, hashing)
+		}
+	}
+
+	stripMetadata, err := ParseMetadataPolicy(c["StripMetadata"])
+	if err != nil {
+		return nil, fmt.Errorf("Configuration of source %q errornous: %w", urlName, err)
+	}
+
+	watermark, err := ParseWatermark(c)
+	if err != nil {
+		return nil, fmt.Errorf("Configuration of source %q errornous: %w", urlName, err)
+	}
+
 	s := &SourceFolder{
-		parent:   parent,
-		index:    index,
-		name:     name,
-		urlName:  urlName,
-		filePath: path,
-		hidden:   hidden,
-		home:     home,
+		parent:        parent,
+		index:         index,
+		name:          name,
+		urlName:       urlName,
+		filePath:      path,
+		hidden:        hidden,
+		home:          home,
+		contentHash:   contentHash,
+		stripMetadata: stripMetadata,
+		watermark:     watermark,
+		access:        ParseAccessPolicy(c, urlName, name),
 	}
 
 	// Add tags source pointing towards the source folder itself
@@ -145,17 +176,40 @@ func (s *SourceFolder) Children() ([]Element, error) {
 			// Is directory
 			// Return a new SourceFolder object of the subfolder
 			album := &SourceFolder{
-				parent:   s,
-				index:    len(elements),
-				name:     file.Name(),
-				urlName:  strings.ToLower(file.Name()),
-				filePath: filepath.Join(s.filePath, file.Name()),
+				parent:        s,
+				index:         len(elements),
+				name:          file.Name(),
+				urlName:       strings.ToLower(file.Name()),
+				filePath:      filepath.Join(s.filePath, file.Name()),
+				contentHash:   s.contentHash,
+				stripMetadata: s.stripMetadata,
+				watermark:     s.watermark,
+				access:        s.access,
+			}
+
+			// The manifest of a subfolder can add a password to it.
+			// If it can't be read, it may contain a password, so the folder is locked for everyone
+			manifest, err := readFolderManifest(album.filePath)
+			if err != nil {
+				log.Errorf("Couldn't read manifest of folder %q, denying access to it: %v", album.filePath, err)
+				album.access = album.access.Merge(AccessPolicy{Protections: []*Protection{newLockedProtection("folder "+album.filePath, album.name)}})
+			} else if manifest.Password != "" {
+				album.access = album.access.Merge(AccessPolicy{Protections: []*Protection{newProtection("folder "+album.filePath, album.name, manifest.Password)}})
 			}
 			elements = append(elements, album)
 		}
 	}
 
+	// Map of all files by their lower case name, used to look up sidecar files
+	filesByName := make(map[string]os.FileInfo, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			filesByName[strings.ToLower(file.Name())] = file
+		}
+	}
+
 	// Add images
+	// Sidecar files are not in the list of valid extensions, so they will not show up as elements
 	for _, file := range files {
 		if !file.IsDir() {
 			// Is file
@@ -170,6 +224,11 @@ func (s *SourceFolder) Children() ([]Element, error) {
 					s:        s,
 					filePath: filepath.Join(s.filePath, file.Name()),
 					fileInfo: file,
+					access:   s.access,
+				}
+				if sidecar := findSidecar(filesByName, file.Name()); sidecar != nil {
+					img.sidecarPath = filepath.Join(s.filePath, sidecar.Name())
+					img.sidecarInfo = sidecar
 				}
 				elements = append(elements, img)
 			}
@@ -179,6 +238,15 @@ func (s *SourceFolder) Children() ([]Element, error) {
 	return elements, nil
 }
 
+// AccessPolicy returns the access policy of the element itself.
+func (s *SourceFolder) AccessPolicy() AccessPolicy {
+	return s.access
+}
+
+func (s *SourceFolder) inheritAccessPolicy(p AccessPolicy) {
+	s.access = s.access.Merge(p)
+}
+
 // Path returns the absolute path of the element, but not the filesystem path.
 // For details see ElementPath.
 func (s *SourceFolder) Path() string {
@@ -219,6 +287,23 @@ func (s *SourceFolder) String() string {
 	return fmt.Sprintf("{SourceFolder %q: %q}", s.Path(), s.filePath)
 }
 
+// findSidecar returns the XMP sidecar file of the image file with the given name, or nil if there is none.
+// Both the IMG_1.jpg.xmp and the IMG_1.xmp naming conventions are supported, the former takes precedence.
+//
+// filesByName is a map of all files in the folder indexed by their lower case name.
+func findSidecar(filesByName map[string]os.FileInfo, name string) os.FileInfo {
+	name = strings.ToLower(name)
+
+	if file, ok := filesByName[name+".xmp"]; ok {
+		return file
+	}
+	if file, ok := filesByName[strings.TrimSuffix(name, filepath.Ext(name))+".xmp"]; ok {
+		return file
+	}
+
+	return nil
+}
+
 // SourceFolderImage represents an image that is contained in a locally accessible folder.
 type SourceFolderImage struct {
 	parent        Element
@@ -227,12 +312,19 @@ type SourceFolderImage struct {
 	s             *SourceFolder
 	filePath      string // The path to the file in the filesystem
 	fileInfo      os.FileInfo
+	sidecarPath   string      // The path to the XMP sidecar file in the filesystem, if there is any
+	sidecarInfo   os.FileInfo // Is nil if there is no sidecar file
+	access        AccessPolicy
 	cacheEntry    *CacheEntry
 }
 
 // Compile time check if SourceFolderImage implements Image and Element.
 var _ Element = (*SourceFolderImage)(nil)
 var _ Image = (*SourceFolderImage)(nil)
+var _ ImageSidecar = (*SourceFolderImage)(nil)
+var _ ImageMetadataPolicy = (*SourceFolderImage)(nil)
+var _ ImageWatermark = (*SourceFolderImage)(nil)
+var _ ElementAccessPolicy = (*SourceFolderImage)(nil)
 
 // Clone returns a clone with the given parent and index set
 func (si *SourceFolderImage) Clone(parent Element, index int) Element {
@@ -260,6 +352,15 @@ func (si *SourceFolderImage) Children() ([]Element, error) {
 	return []Element{}, nil
 }
 
+// AccessPolicy returns the access policy of the element itself.
+func (si *SourceFolderImage) AccessPolicy() AccessPolicy {
+	return si.access
+}
+
+func (si *SourceFolderImage) inheritAccessPolicy(p AccessPolicy) {
+	si.access = si.access.Merge(p)
+}
+
 // Path returns the absolute path of the element, but not the filesystem path.
 // For details see ElementPath.
 func (si *SourceFolderImage) Path() string {
@@ -307,12 +408,54 @@ func (si *SourceFolderImage) Traverse(path string) (Element, error) {
 }
 
 // Hash returns a unique hash that stays the same as long as the file doesn't change.
+//
+// If the source uses content based hashing, the hash is derived from the content of the image and its sidecar file.
+// That way it stays the same when the file is moved, and can be used as permalink.
+// Otherwise it's derived from the path and modification time, which is faster for new files.
 func (si *SourceFolderImage) Hash() string {
+	if si.s.contentHash {
+		hash, err := si.contentHash()
+		if err == nil {
+			return hash
+		}
+		log.Warnf("Couldn't get content hash of %v, using its path instead: %v", si, err)
+	}
+
 	h := sha256.New()
 	h.Write([]byte(fmt.Sprintf("SourceFolderImage %q %v", si.filePath, si.fileInfo.ModTime()))) // This should be unique enough
+	if si.sidecarInfo != nil {
+		// Changes to the sidecar file should invalidate the cache entry, too
+		h.Write([]byte(fmt.Sprintf(" Sidecar %q %v", si.sidecarPath, si.sidecarInfo.ModTime())))
+	}
+	if si.s.watermark != nil {
+		// Watermarked images need their own cache entries
+		h.Write([]byte(fmt.Sprintf(" Watermark %v", si.s.watermark.id)))
+	}
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// contentHash returns a hash that is derived from the content of the image and its sidecar file.
+func (si *SourceFolderImage) contentHash() (string, error) {
+	digest, err := contentHashes.Digest(si.filePath, si.fileInfo)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("SourceFolderImage content %v", digest)))
+	if si.sidecarInfo != nil {
+		sidecarDigest, err := contentHashes.Digest(si.sidecarPath, si.sidecarInfo)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(fmt.Sprintf(" Sidecar %v", sidecarDigest)))
+	}
+	if si.s.watermark != nil {
+		h.Write([]byte(fmt.Sprintf(" Watermark %v", si.s.watermark.id)))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 // CacheEntry returns the cache entry of the image.
 //
 // This function is similar to calling QueryCacheEntryImage with the image's hash.
@@ -376,6 +519,30 @@ func (si *SourceFolderImage) FileContent() (io.ReadCloser, int64, string, error)
 	return f, stat.Size(), ExtToMIME(filepath.Ext(f.Name())), err
 }
 
+// ModTime returns the modification time of the image file.
+func (si *SourceFolderImage) ModTime() time.Time {
+	return si.fileInfo.ModTime()
+}
+
+// MetadataPolicy returns the metadata that has to be removed from the image file before it is sent.
+func (si *SourceFolderImage) MetadataPolicy() MetadataPolicy {
+	return si.s.stripMetadata
+}
+
+// Watermark returns the watermark that has to be drawn over the image, or nil if there is none.
+func (si *SourceFolderImage) Watermark() *Watermark {
+	return si.s.watermark
+}
+
+// SidecarContent returns the XMP sidecar file of the image, or nil if there is none.
+func (si *SourceFolderImage) SidecarContent() (io.ReadCloser, error) {
+	if si.sidecarInfo == nil {
+		return nil, nil
+	}
+
+	return os.Open(si.sidecarPath)
+}
+
 func (si *SourceFolderImage) String() string {
 	return fmt.Sprintf("{SourceFolderImage %q: %q}", si.Path(), si.filePath)
 }
@@ -0,0 +1,62 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFileInfo is a file that only has a name.
+type testFileInfo string
+
+func (fi testFileInfo) Name() string       { return string(fi) }
+func (fi testFileInfo) Size() int64        { return 0 }
+func (fi testFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi testFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi testFileInfo) IsDir() bool        { return false }
+func (fi testFileInfo) Sys() interface{}   { return nil }
+
+func TestFindSidecar(t *testing.T) {
+	filesByName := map[string]os.FileInfo{}
+	for _, name := range []string{"IMG_1.JPG", "IMG_1.xmp", "IMG_2.jpg", "img_2.jpg.XMP", "IMG_2.xmp", "IMG_3.jpg", "IMG_4.tar.gz", "IMG_4.tar.xmp"} {
+		filesByName[strings.ToLower(name)] = testFileInfo(name)
+	}
+
+	tests := []struct {
+		name, want string
+	}{
+		{"IMG_1.JPG", "IMG_1.xmp"},
+		{"IMG_2.jpg", "img_2.jpg.XMP"}, // IMG_2.jpg.xmp takes precedence over IMG_2.xmp
+		{"IMG_3.jpg", ""},
+		{"IMG_4.tar.gz", "IMG_4.tar.xmp"},
+		{"IMG_5.jpg", ""},
+	}
+
+	for _, test := range tests {
+		got := ""
+		if sidecar := findSidecar(filesByName, test.name); sidecar != nil {
+			got = sidecar.Name()
+		}
+		if got != test.want {
+			t.Errorf("Got sidecar %q for %q, want %q", got, test.name, test.want)
+		}
+	}
+}
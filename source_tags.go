@@ -40,10 +40,12 @@ type SourceTags struct {
 	internalPaths []string
 	hidden        bool
 	home          bool
+	access        AccessPolicy
 }
 
 // Compile time check if SourceTags implements Element.
 var _ Element = (*SourceTags)(nil)
+var _ ElementAccessPolicy = (*SourceTags)(nil)
 
 // CreateSourceTags returns a new instance of the source.
 func CreateSourceTags(parent Element, index int, urlName string, c tree.Node) (Element, error) {
@@ -68,6 +70,7 @@ func CreateSourceTags(parent Element, index int, urlName string, c tree.Node) (E
 		internalPaths: paths,
 		hidden:        hidden,
 		home:          home,
+		access:        ParseAccessPolicy(c, urlName, name),
 	}, nil
 }
 
@@ -163,7 +166,7 @@ func (s *SourceTags) Children() ([]Element, error) {
 			index:   len(elements),
 		}
 		for _, tagElement := range tags[tagName] {
-			album.children = append(album.children, tagElement.Clone(album, len(album.children)))
+			album.children = append(album.children, cloneWithAccessPolicy(tagElement, album, len(album.children)))
 		}
 		elements = append(elements, album)
 	}
@@ -171,6 +174,15 @@ func (s *SourceTags) Children() ([]Element, error) {
 	return elements, nil
 }
 
+// AccessPolicy returns the access policy of the element itself.
+func (s *SourceTags) AccessPolicy() AccessPolicy {
+	return s.access
+}
+
+func (s *SourceTags) inheritAccessPolicy(p AccessPolicy) {
+	s.access = s.access.Merge(p)
+}
+
 // Path returns the absolute path of the element, but not the filesystem path.
 // For details see ElementPath.
 func (s *SourceTags) Path() string {
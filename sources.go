@@ -28,45 +28,56 @@ var RootElement = &Album{}
 func loadSources() {
 	// Initialize sources and register callback for config changes
 	conf.RegisterCallback([]string{".Sources"}, func(c *configdb.Config, modified, added, removed []string) {
-		var sourcesConf tree.Node
-		if err := c.Get(".Sources", &sourcesConf); err != nil {
-			log.Errorf("Error while reading configuration file: %v", err)
-			return
-		}
+		reloadSources(c)
 
-		// Initialize and reset the sources
-		RootElement = &Album{}
+		// Make the images of the new sources findable by their hash, and forget the ones that don't exist anymore
+		go cache.IndexImages(RootElement)
 
-		for urlName := range sourcesConf {
-			var sourceConf tree.Node
-			if err := sourcesConf.Get("."+urlName, &sourceConf); err != nil {
-				log.Warnf("Error while reading configuration file: %v", err)
-				continue
-			}
+		// Generate missing cache entries of the new sources in the background
+		cacheWarmer.Start(RootElement)
+	})
+}
 
-			var sourceTypeName string
-			if err := sourceConf.Get(".Type", &sourceTypeName); err != nil {
-				log.Warnf("Error while reading configuration file: %v", err)
-				continue
-			}
+// reloadSources replaces all sources with the ones defined in the given configuration.
+func reloadSources(c *configdb.Config) {
+	var sourcesConf tree.Node
+	if err := c.Get(".Sources", &sourcesConf); err != nil {
+		log.Errorf("Error while reading configuration file: %v", err)
+		return
+	}
 
-			var sourceType SourceType
-			var ok bool
-			if sourceType, ok = SourceTypes[sourceTypeName]; !ok {
-				log.Warnf("Unknown source type %q of %q", sourceTypeName, urlName)
-				continue
-			}
+	// Initialize and reset the sources
+	RootElement = &Album{}
 
-			// Create new source of the given type and forward its configuration
-			index := len(RootElement.children)
-			if sourceInstance, err := sourceType.create(RootElement, index, urlName, sourceConf); err == nil {
-				RootElement.children = append(RootElement.children, sourceInstance)
-				log.Debugf("Created new instance %q of source %q", urlName, sourceTypeName)
-			} else {
-				log.Errorf("Couldn't create instance %q of source %q: %v", urlName, sourceTypeName, err)
-			}
+	for urlName := range sourcesConf {
+		var sourceConf tree.Node
+		if err := sourcesConf.Get("."+urlName, &sourceConf); err != nil {
+			log.Warnf("Error while reading configuration file: %v", err)
+			continue
 		}
 
-		log.Info("Loaded sources from configuration")
-	})
+		var sourceTypeName string
+		if err := sourceConf.Get(".Type", &sourceTypeName); err != nil {
+			log.Warnf("Error while reading configuration file: %v", err)
+			continue
+		}
+
+		var sourceType SourceType
+		var ok bool
+		if sourceType, ok = SourceTypes[sourceTypeName]; !ok {
+			log.Warnf("Unknown source type %q of %q", sourceTypeName, urlName)
+			continue
+		}
+
+		// Create new source of the given type and forward its configuration
+		index := len(RootElement.children)
+		if sourceInstance, err := sourceType.create(RootElement, index, urlName, sourceConf); err == nil {
+			RootElement.children = append(RootElement.children, sourceInstance)
+			log.Debugf("Created new instance %q of source %q", urlName, sourceTypeName)
+		} else {
+			log.Errorf("Couldn't create instance %q of source %q: %v", urlName, sourceTypeName, err)
+		}
+	}
+
+	log.Info("Loaded sources from configuration")
 }
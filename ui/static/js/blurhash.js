@@ -0,0 +1,96 @@
+// Decoder for BlurHash strings, see https://blurha.sh.
+// The placeholders of images are stored as BlurHash, see blurhash.go.
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~";
+
+// blurHashDecode83 returns the value of a base 83 encoded string.
+function blurHashDecode83(str) {
+    let value = 0;
+    for (const c of str) {
+        value = value * 83 + blurHashCharacters.indexOf(c);
+    }
+    return value;
+}
+
+function blurHashSRGBToLinear(value) {
+    let v = value / 255;
+    if (v <= 0.04045) {
+        return v / 12.92;
+    }
+    return Math.pow((v + 0.055) / 1.055, 2.4);
+}
+
+function blurHashLinearToSRGB(value) {
+    let v = Math.max(0, Math.min(1, value));
+    if (v <= 0.0031308) {
+        return Math.round(v * 12.92 * 255);
+    }
+    return Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+}
+
+// blurHashDecode returns the pixels of the image described by the BlurHash, as RGBA values.
+function blurHashDecode(hash, width, height) {
+    let sizeFlag = blurHashDecode83(hash[0]);
+    let numX = (sizeFlag % 9) + 1, numY = Math.floor(sizeFlag / 9) + 1;
+    if (hash.length !== 4 + 2 * numX * numY) {
+        throw new Error("Invalid BlurHash length");
+    }
+
+    let maximumValue = (blurHashDecode83(hash[1]) + 1) / 166;
+    let colors = [];
+    let dc = blurHashDecode83(hash.substring(2, 6));
+    colors.push([blurHashSRGBToLinear(dc >> 16), blurHashSRGBToLinear((dc >> 8) & 255), blurHashSRGBToLinear(dc & 255)]);
+    for (let i = 1; i < numX * numY; i++) {
+        let value = blurHashDecode83(hash.substring(4 + i * 2, 6 + i * 2));
+        colors.push([Math.floor(value / (19 * 19)), Math.floor(value / 19) % 19, value % 19].map(function (q) {
+            let v = (q - 9) / 9;
+            return Math.sign(v) * v * v * maximumValue;
+        }));
+    }
+
+    let pixels = new Uint8ClampedArray(width * height * 4);
+    for (let y = 0; y < height; y++) {
+        for (let x = 0; x < width; x++) {
+            let r = 0, g = 0, b = 0;
+            for (let j = 0; j < numY; j++) {
+                for (let i = 0; i < numX; i++) {
+                    let basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+                    let color = colors[i + j * numX];
+                    r += color[0] * basis;
+                    g += color[1] * basis;
+                    b += color[2] * basis;
+                }
+            }
+            let index = 4 * (x + y * width);
+            pixels[index + 0] = blurHashLinearToSRGB(r);
+            pixels[index + 1] = blurHashLinearToSRGB(g);
+            pixels[index + 2] = blurHashLinearToSRGB(b);
+            pixels[index + 3] = 255;
+        }
+    }
+    return pixels;
+}
+
+// placeholderURL returns an URL that can be used as background image while the real image is loading.
+// The placeholder is the BlurHash of the image.
+// width and height are only used to get the aspect ratio of the image.
+function placeholderURL(placeholder, width, height) {
+    if (!placeholder) {
+        return "";
+    }
+
+    let canvasWidth = 32, canvasHeight = Math.max(1, Math.min(128, Math.round(32 * height / width)));
+    let canvas = document.createElement("canvas");
+    canvas.width = canvasWidth;
+    canvas.height = canvasHeight;
+    let ctx = canvas.getContext("2d");
+    try {
+        let imageData = ctx.createImageData(canvasWidth, canvasHeight);
+        imageData.data.set(blurHashDecode(placeholder, canvasWidth, canvasHeight));
+        ctx.putImageData(imageData, 0, 0);
+    } catch (e) {
+        console.error(e);
+        return "";
+    }
+    return canvas.toDataURL();
+}
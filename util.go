@@ -18,9 +18,7 @@
 package main
 
 import (
-	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"strings"
 )
 
@@ -39,24 +37,29 @@ func ExtToMIME(ext string) string {
 	return "application/octet-stream"
 }
 
-// ImageToDataURI takes the result from FileContent and returns an data URI that can be embedded into HTML or CSS.
-// This will close the stream f.
-func ImageToDataURI(img Image) (string, error) {
+// ImagePlaceholder returns the placeholder of an image that is shown while the image is loading.
+// This is the BlurHash of the image, which the browser decodes with placeholderURL, see ui/static/js/blurhash.js.
+func ImagePlaceholder(img Image) (string, error) {
 	ce, err := img.CacheEntry()
 	if err != nil {
 		return "", fmt.Errorf("Couldn't find cache entry for %v: %w", img, err)
 	}
 
-	f, _, mime, err := ce.NanoImage()
+	return ce.BlurHash, nil
+}
+
+// ImageSrcSet returns the value of a srcset attribute that lists all reduced versions of an image.
+// The result is empty for cache entries that don't contain a list of reduced versions.
+func ImageSrcSet(img Image) (string, error) {
+	ce, err := img.CacheEntry()
 	if err != nil {
-		return "", fmt.Errorf("Couldn't get file of image %v: %w", img, err)
+		return "", fmt.Errorf("Couldn't find cache entry for %v: %w", img, err)
 	}
-	defer f.Close()
 
-	buf, err := ioutil.ReadAll(f)
-	if err != nil {
-		return "", fmt.Errorf("Couldn't read file content of image %v: %w", img, err)
+	candidates := []string{}
+	for _, rendition := range ce.Renditions {
+		candidates = append(candidates, fmt.Sprintf("/cached/%v/%d %dw", ce.hash, rendition.Height, rendition.Width))
 	}
 
-	return fmt.Sprintf("data:%v;base64,%v", mime, base64.StdEncoding.EncodeToString(buf)), nil
+	return strings.Join(candidates, ", "), nil
 }
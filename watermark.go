@@ -0,0 +1,264 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Dadido3/configdb/tree"
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermark is an image or a text that is drawn over the images of a source.
+type Watermark struct {
+	overlay   image.Image // The watermark itself, transparent where the image should be visible
+	position  string      // Where the watermark is placed, see watermarkPositions
+	opacity   float64     // Opacity of the watermark between 0 and 1
+	scale     float64     // Width of the watermark relative to the width of the image
+	originals bool        // Whether original images are watermarked, too
+	id        string      // Hash of all settings and the overlay. Images with a watermark get a different hash, so their cache entries are kept apart
+}
+
+// watermarkPositions contains the anchor of every possible watermark position, relative to the image size.
+var watermarkPositions = map[string]image.Point{
+	"top-left":     {0, 0},
+	"top":          {1, 0},
+	"top-right":    {2, 0},
+	"left":         {0, 1},
+	"center":       {1, 1},
+	"right":        {2, 1},
+	"bottom-left":  {0, 2},
+	"bottom":       {1, 2},
+	"bottom-right": {2, 2},
+}
+
+// ParseWatermark returns the watermark that is defined in the Watermark key of a source configuration.
+// If there is no such key, nil is returned.
+func ParseWatermark(c tree.Node) (*Watermark, error) {
+	if _, ok := c["Watermark"]; !ok {
+		return nil, nil
+	}
+
+	var imagePath, text string
+	c.Get(".Watermark.Image", &imagePath)
+	c.Get(".Watermark.Text", &text)
+
+	wm := &Watermark{position: "bottom-right", opacity: 0.5, scale: 0.2}
+	c.Get(".Watermark.Position", &wm.position)
+	c.Get(".Watermark.Opacity", &wm.opacity)
+	c.Get(".Watermark.Scale", &wm.scale)
+	c.Get(".Watermark.Originals", &wm.originals)
+
+	if _, ok := watermarkPositions[wm.position]; !ok {
+		return nil, fmt.Errorf("Unknown watermark position %q", wm.position)
+	}
+	if wm.opacity <= 0 || wm.opacity > 1 {
+		return nil, fmt.Errorf("Watermark opacity %v is not between 0 and 1", wm.opacity)
+	}
+	if wm.scale <= 0 || wm.scale > 1 {
+		return nil, fmt.Errorf("Watermark scale %v is not between 0 and 1", wm.scale)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("Watermark %q %q %v %v", text, wm.position, wm.opacity, wm.scale)))
+
+	switch {
+	case imagePath != "":
+		data, err := ioutil.ReadFile(imagePath)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read watermark image: %w", err)
+		}
+		if wm.overlay, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("Couldn't decode watermark image %q: %w", imagePath, err)
+		}
+		h.Write(data)
+	case text != "":
+		wm.overlay = renderWatermarkText(text)
+	default:
+		return nil, fmt.Errorf("Watermark needs either an image or a text")
+	}
+
+	wm.id = fmt.Sprintf("%x", h.Sum(nil))
+
+	return wm, nil
+}
+
+// renderWatermarkText returns an image of the given text in white with a dark outline, so it's readable on any background.
+// The text is rendered with a small bitmap font, as it's scaled to its final size anyway.
+func renderWatermarkText(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	img := image.NewNRGBA(image.Rect(0, 0, width+2, face.Height+2))
+
+	d := font.Drawer{Dst: img, Face: face}
+	for _, offset := range []image.Point{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {2, 1}, {0, 2}, {1, 2}, {2, 2}} {
+		d.Src, d.Dot = image.NewUniform(color.NRGBA{0, 0, 0, 0xC0}), fixed.P(offset.X, face.Ascent+offset.Y)
+		d.DrawString(text)
+	}
+	d.Src, d.Dot = image.White, fixed.P(1, face.Ascent+1)
+	d.DrawString(text)
+
+	return img
+}
+
+// Apply returns a copy of the image with the watermark drawn over it.
+// The watermark is scaled relative to the width of the image, so it looks the same on every reduced version.
+// On images that are too wide for that, like panoramas, the watermark is scaled down to the height of the image instead.
+func (wm *Watermark) Apply(img image.Image) image.Image {
+	bounds, overlayBounds := img.Bounds(), wm.overlay.Bounds()
+
+	width := int(float64(bounds.Dx()) * wm.scale)
+	height := width * overlayBounds.Dy() / overlayBounds.Dx()
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+		width = height * overlayBounds.Dx() / overlayBounds.Dy()
+	}
+	if width < 1 || height < 1 {
+		return img
+	}
+	overlay := resize.Resize(uint(width), uint(height), wm.overlay, resize.Bilinear)
+
+	// Keep some distance to the borders of the image
+	margin := bounds.Dx()
+	if bounds.Dy() < margin {
+		margin = bounds.Dy()
+	}
+	margin = margin / 50
+	if bounds.Dx()-2*margin < width || bounds.Dy()-2*margin < height {
+		margin = 0
+	}
+
+	anchor := watermarkPositions[wm.position]
+	pos := image.Point{
+		X: bounds.Min.X + margin + anchor.X*(bounds.Dx()-2*margin-width)/2,
+		Y: bounds.Min.Y + margin + anchor.Y*(bounds.Dy()-2*margin-height)/2,
+	}
+
+	result := image.NewRGBA(bounds)
+	draw.Draw(result, bounds, img, bounds.Min, draw.Src)
+	mask := image.NewUniform(color.Alpha{uint8(wm.opacity * 0xFF)})
+	draw.DrawMask(result, image.Rectangle{pos, pos.Add(image.Pt(width, height))}, overlay, overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+
+	return result
+}
+
+// ImageWatermark is implemented by images that have to be watermarked.
+type ImageWatermark interface {
+	Watermark() *Watermark // Returns the watermark of the source of the image, or nil if there is none
+}
+
+// imageWatermark returns the watermark of the image, or nil if there is none.
+func imageWatermark(img Image) *Watermark {
+	if i, ok := img.(ImageWatermark); ok {
+		return i.Watermark()
+	}
+	return nil
+}
+
+// watermarkedOriginalQuality is the JPEG quality of watermarked original images.
+const watermarkedOriginalQuality = 95
+
+// WatermarkedOriginal returns the original image with the given watermark as JPEG file.
+// The file is generated on the first request, and is stored in the cache from then on.
+//
+// Images that exceed the pixel limit of the cache can't be watermarked, an error is returned for them.
+func (c *Cache) WatermarkedOriginal(imgElement Image, wm *Watermark) (io.ReadSeekCloser, CacheFileInfo, error) {
+	name := watermarkedOriginalName(imgElement.Hash())
+
+	if f, info, err := c.storage.Open(name); err == nil {
+		c.accessFile(name)
+		return f, info, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("Couldn't open watermarked original %q, it will be regenerated: %v", name, err)
+	}
+
+	data, err := c.generateWatermarkedOriginal(imgElement, wm)
+	if err != nil {
+		return nil, CacheFileInfo{}, err
+	}
+
+	if err := c.storage.Write(name, data); err != nil {
+		return nil, CacheFileInfo{}, fmt.Errorf("Couldn't store watermarked original of %v: %w", imgElement, err)
+	}
+	c.trackFile(name, int64(len(data)))
+
+	f, info, err := c.storage.Open(name)
+	if err != nil {
+		return nil, CacheFileInfo{}, err
+	}
+	return f, info, nil
+}
+
+// generateWatermarkedOriginal decodes the original image, and returns it with the watermark as JPEG file.
+func (c *Cache) generateWatermarkedOriginal(imgElement Image, wm *Watermark) ([]byte, error) {
+	c.decodeSlots <- struct{}{}
+	defer func() { <-c.decodeSlots }()
+
+	configFile, _, _, err := imgElement.FileContent()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get original image from %v: %w", imgElement, err)
+	}
+	config, _, err := image.DecodeConfig(configFile)
+	configFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode image configuration of %v: %w", imgElement, err)
+	}
+	if c.exceedsPixelLimit(config.Width, config.Height) {
+		return nil, fmt.Errorf("Image %v exceeds the pixel limit and can't be watermarked", imgElement)
+	}
+
+	file, _, _, err := imgElement.FileContent()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get original image from %v: %w", imgElement, err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode image %v: %w", imgElement, err)
+	}
+
+	convertColors, embedProfile := imageColorConversion(imgElement)
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, wm.Apply(convertColors(img)), &jpeg.Options{Quality: watermarkedOriginalQuality}); err != nil {
+		return nil, fmt.Errorf("Couldn't encode watermarked image %v: %w", imgElement, err)
+	}
+
+	data := buf.Bytes()
+	if embedProfile != nil {
+		if data, err = jpegEmbedICCProfile(data, embedProfile); err != nil {
+			return nil, fmt.Errorf("Couldn't embed ICC profile into watermarked image %v: %w", imgElement, err)
+		}
+	}
+
+	return data, nil
+}
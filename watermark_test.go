@@ -0,0 +1,49 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestWatermarkApplyFitsImage(t *testing.T) {
+	wm := &Watermark{overlay: renderWatermarkText("Galago"), position: "bottom-right", opacity: 1, scale: 1}
+
+	// The overlay scaled to the full width is higher than the image, so it has to be scaled to the image height instead
+	img := image.NewRGBA(image.Rect(0, 0, 400, 20))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+
+	result := wm.Apply(img)
+	if result == image.Image(img) {
+		t.Fatal("Watermark wasn't applied")
+	}
+
+	changed := false
+	for y := 0; y < 20 && !changed; y++ {
+		for x := 0; x < 400 && !changed; x++ {
+			changed = result.At(x, y) != color.Color(color.RGBA{0x80, 0x80, 0x80, 0x80})
+		}
+	}
+	if !changed {
+		t.Error("Watermarked image is unchanged")
+	}
+}
@@ -0,0 +1,910 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// This file implements a simple lossy WebP encoder.
+//
+// It writes a single VP8 key frame, as specified in RFC 6386.
+// To keep things simple, only the 16x16 luma and 8x8 chroma intra prediction modes are used.
+// The mode of each macroblock is chosen by the smallest difference to the source image.
+// Token probabilities are not optimized, the default probabilities are used instead.
+// Because of these limitations, the result is often larger than a JPEG file of similar quality.
+// Reduced images are therefore only served as WebP if that's smaller than their JPEG version, see CacheEntry.ReducedImage.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// WebPOptions are the encoding parameters for EncodeWebP.
+type WebPOptions struct {
+	Quality    int    // Quality between 1 and 100, higher is better. Defaults to 75
+	ICCProfile []byte // Optional ICC profile that will be embedded into the file
+}
+
+// EncodeWebP writes the image in the lossy WebP format to w.
+// Any alpha channel of the image is ignored.
+func EncodeWebP(w io.Writer, img image.Image, o *WebPOptions) error {
+	quality := 75
+	var iccProfile []byte
+	if o != nil {
+		if o.Quality > 0 {
+			quality = o.Quality
+		}
+		iccProfile = o.ICCProfile
+	}
+	if quality > 100 {
+		quality = 100
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > 16383 || height > 16383 {
+		return fmt.Errorf("invalid image size %dx%d for WebP", width, height)
+	}
+
+	// Map the quality linearly to the quantizer index
+	qi := (100 - quality) * 127 / 100
+
+	frame := newVP8Encoder(img, qi).encode()
+
+	// Write RIFF container
+	chunks := new(bytes.Buffer)
+	if iccProfile != nil {
+		// The extended format is needed to store an ICC profile
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x20 // ICC profile flag
+		putUint24LE(vp8x[4:], uint32(width-1))
+		putUint24LE(vp8x[7:], uint32(height-1))
+		writeRIFFChunk(chunks, "VP8X", vp8x)
+		writeRIFFChunk(chunks, "ICCP", iccProfile)
+	}
+	writeRIFFChunk(chunks, "VP8 ", frame)
+
+	header := make([]byte, 12)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+chunks.Len()))
+	copy(header[8:12], "WEBP")
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := chunks.WriteTo(w)
+	return err
+}
+
+// writeRIFFChunk writes a RIFF chunk including its header and padding.
+func writeRIFFChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	buf.WriteString(fourCC)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+func putUint24LE(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// vp8BoolEncoder is the boolean entropy encoder, as specified in section 7.3.
+type vp8BoolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newVP8BoolEncoder() *vp8BoolEncoder {
+	return &vp8BoolEncoder{rng: 255, bitCount: 24}
+}
+
+// addOne propagates a carry into the already written bytes.
+func (e *vp8BoolEncoder) addOne() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 255 {
+		e.buf[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+// writeBool writes a single bit, where prob is the probability of the bit being false in 1/256 units.
+func (e *vp8BoolEncoder) writeBool(bit bool, prob uint8) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= (1 << 24) - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// writeLiteral writes an n bit unsigned value, most significant bit first.
+func (e *vp8BoolEncoder) writeLiteral(v uint32, n int) {
+	for n > 0 {
+		n--
+		e.writeBool(v&(1<<uint(n)) != 0, 128)
+	}
+}
+
+// flush writes any remaining bits and returns the encoded data.
+func (e *vp8BoolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<uint(32-c)) != 0 {
+		e.addOne()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.buf = append(e.buf, byte(v>>24))
+		v <<= 8
+	}
+	return e.buf
+}
+
+// Intra prediction modes as they are used in the encoder.
+const (
+	vp8PredDC = iota
+	vp8PredV
+	vp8PredH
+	vp8PredTM
+)
+
+// vp8NonZero contains the flags of blocks with non zero coefficients along the edge of a macroblock.
+// They are used as context for the token probabilities.
+type vp8NonZero struct {
+	y  [4]uint8
+	u  [2]uint8
+	v  [2]uint8
+	y2 uint8
+}
+
+// vp8MBInfo contains the header of an encoded macroblock.
+type vp8MBInfo struct {
+	yMode, uvMode int
+	skip          bool
+}
+
+// vp8Encoder contains the state of encoding a single key frame.
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+	qi            int
+
+	// Source and reconstructed planes, padded to full macroblocks
+	yStride, cStride       int
+	srcY, srcU, srcV       []uint8
+	recY, recU, recV       []uint8
+	qY1, qY2, qUV          [2]int32 // DC and AC quantization factors
+	mbInfo                 []vp8MBInfo
+	tokens                 *vp8BoolEncoder
+	upNonZero              []vp8NonZero
+	leftNonZero            vp8NonZero
+	skipCount              int
+	predBuf16, predBuf16UV [4][256]uint8 // Scratch space for the predictions of all modes
+}
+
+func newVP8Encoder(img image.Image, qi int) *vp8Encoder {
+	bounds := img.Bounds()
+	e := &vp8Encoder{
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+		qi:     qi,
+		tokens: newVP8BoolEncoder(),
+	}
+	e.mbw, e.mbh = (e.width+15)/16, (e.height+15)/16
+	e.yStride, e.cStride = e.mbw*16, e.mbw*8
+	e.srcY = make([]uint8, e.yStride*e.mbh*16)
+	e.srcU = make([]uint8, e.cStride*e.mbh*8)
+	e.srcV = make([]uint8, e.cStride*e.mbh*8)
+	e.recY = make([]uint8, len(e.srcY))
+	e.recU = make([]uint8, len(e.srcU))
+	e.recV = make([]uint8, len(e.srcV))
+	e.mbInfo = make([]vp8MBInfo, e.mbw*e.mbh)
+	e.upNonZero = make([]vp8NonZero, e.mbw)
+
+	e.qY1 = [2]int32{int32(vp8DequantTableDC[qi]), int32(vp8DequantTableAC[qi])}
+	e.qY2 = [2]int32{int32(vp8DequantTableDC[qi]) * 2, int32(vp8DequantTableAC[qi]) * 155 / 100}
+	if e.qY2[1] < 8 {
+		e.qY2[1] = 8
+	}
+	uvDCIndex := qi
+	if uvDCIndex > 117 {
+		uvDCIndex = 117
+	}
+	e.qUV = [2]int32{int32(vp8DequantTableDC[uvDCIndex]), int32(vp8DequantTableAC[qi])}
+
+	e.importImage(img)
+
+	return e
+}
+
+// importImage converts the image into the padded Y'CbCr planes.
+// This uses the same BT.601 conversion with limited range as libwebp.
+func (e *vp8Encoder) importImage(img image.Image) {
+	bounds := img.Bounds()
+
+	// Get 8 bit RGB values of the image, edges are repeated to fill the padding
+	rgbStride := e.mbw * 16
+	rgb := make([]int32, rgbStride*e.mbh*16*3)
+	pixel := func(x, y int) (r, g, b int32) {
+		switch img := img.(type) {
+		case *image.RGBA:
+			i := img.PixOffset(x, y)
+			return int32(img.Pix[i]), int32(img.Pix[i+1]), int32(img.Pix[i+2])
+		case *image.NRGBA:
+			i := img.PixOffset(x, y)
+			return int32(img.Pix[i]), int32(img.Pix[i+1]), int32(img.Pix[i+2])
+		}
+		r16, g16, b16, _ := img.At(x, y).RGBA()
+		return int32(r16 >> 8), int32(g16 >> 8), int32(b16 >> 8)
+	}
+	for y := 0; y < e.mbh*16; y++ {
+		sy := y
+		if sy >= e.height {
+			sy = e.height - 1
+		}
+		for x := 0; x < e.mbw*16; x++ {
+			sx := x
+			if sx >= e.width {
+				sx = e.width - 1
+			}
+			r, g, b := pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+			i := (y*rgbStride + x) * 3
+			rgb[i], rgb[i+1], rgb[i+2] = r, g, b
+		}
+	}
+
+	for y := 0; y < e.mbh*16; y++ {
+		for x := 0; x < e.mbw*16; x++ {
+			i := (y*rgbStride + x) * 3
+			r, g, b := rgb[i], rgb[i+1], rgb[i+2]
+			e.srcY[y*e.yStride+x] = uint8((16839*r + 33059*g + 6420*b + (16 << 16) + (1 << 15)) >> 16)
+		}
+	}
+
+	// Chroma is computed from the average of 2x2 pixels
+	for y := 0; y < e.mbh*8; y++ {
+		for x := 0; x < e.mbw*8; x++ {
+			var r, g, b int32
+			for _, o := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				i := ((y*2+o[1])*rgbStride + x*2 + o[0]) * 3
+				r, g, b = r+rgb[i], g+rgb[i+1], b+rgb[i+2]
+			}
+			u := (-9719*r - 19081*g + 28800*b + (128 << 18) + (1 << 17)) >> 18
+			v := (28800*r - 24116*g - 4684*b + (128 << 18) + (1 << 17)) >> 18
+			e.srcU[y*e.cStride+x] = clip8(u)
+			e.srcV[y*e.cStride+x] = clip8(v)
+		}
+	}
+}
+
+func clip8(v int32) uint8 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(v)
+}
+
+// encode encodes the whole key frame and returns the VP8 bitstream.
+func (e *vp8Encoder) encode() []byte {
+	for mby := 0; mby < e.mbh; mby++ {
+		e.leftNonZero = vp8NonZero{}
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+	tokenPartition := e.tokens.flush()
+
+	firstPartition := e.encodeFirstPartition()
+
+	// Frame tag and key frame header
+	frame := make([]byte, 10, 10+len(firstPartition)+len(tokenPartition))
+	tag := uint32(1<<4) | uint32(len(firstPartition))<<5 // Key frame, version 0, show frame
+	putUint24LE(frame[0:3], tag)
+	frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+	binary.LittleEndian.PutUint16(frame[6:8], uint16(e.width))
+	binary.LittleEndian.PutUint16(frame[8:10], uint16(e.height))
+	frame = append(frame, firstPartition...)
+	frame = append(frame, tokenPartition...)
+
+	return frame
+}
+
+// encodeFirstPartition writes the frame header and the headers of all macroblocks.
+func (e *vp8Encoder) encodeFirstPartition() []byte {
+	fp := newVP8BoolEncoder()
+
+	fp.writeLiteral(0, 1) // Color space
+	fp.writeLiteral(0, 1) // Clamping type
+	fp.writeLiteral(0, 1) // Segmentation disabled
+
+	// Loop filter, its strength follows the quantizer
+	fp.writeLiteral(0, 1) // Normal filter
+	fp.writeLiteral(uint32(e.qi/2), 6)
+	fp.writeLiteral(0, 3) // Sharpness
+	fp.writeLiteral(0, 1) // No loop filter deltas
+
+	fp.writeLiteral(0, 2) // Single token partition
+
+	fp.writeLiteral(uint32(e.qi), 7)
+	for i := 0; i < 5; i++ {
+		fp.writeLiteral(0, 1) // No quantizer deltas
+	}
+
+	fp.writeLiteral(1, 1) // Refresh entropy probabilities
+
+	// Don't update any token probabilities
+	for i := range vp8TokenProbUpdateProb {
+		for j := range vp8TokenProbUpdateProb[i] {
+			for k := range vp8TokenProbUpdateProb[i][j] {
+				for l := range vp8TokenProbUpdateProb[i][j][k] {
+					fp.writeBool(false, vp8TokenProbUpdateProb[i][j][k][l])
+				}
+			}
+		}
+	}
+
+	// Probability that a macroblock is not skipped
+	probSkipFalse := 255 - 255*e.skipCount/len(e.mbInfo)
+	if probSkipFalse < 1 {
+		probSkipFalse = 1
+	}
+	fp.writeLiteral(1, 1)
+	fp.writeLiteral(uint32(probSkipFalse), 8)
+
+	for _, info := range e.mbInfo {
+		fp.writeBool(info.skip, uint8(probSkipFalse))
+
+		fp.writeBool(true, 145) // 16x16 luma prediction
+		switch info.yMode {
+		case vp8PredDC:
+			fp.writeBool(false, 156)
+			fp.writeBool(false, 163)
+		case vp8PredV:
+			fp.writeBool(false, 156)
+			fp.writeBool(true, 163)
+		case vp8PredH:
+			fp.writeBool(true, 156)
+			fp.writeBool(false, 128)
+		case vp8PredTM:
+			fp.writeBool(true, 156)
+			fp.writeBool(true, 128)
+		}
+
+		switch info.uvMode {
+		case vp8PredDC:
+			fp.writeBool(false, 142)
+		case vp8PredV:
+			fp.writeBool(true, 142)
+			fp.writeBool(false, 114)
+		case vp8PredH:
+			fp.writeBool(true, 142)
+			fp.writeBool(true, 114)
+			fp.writeBool(false, 183)
+		case vp8PredTM:
+			fp.writeBool(true, 142)
+			fp.writeBool(true, 114)
+			fp.writeBool(true, 183)
+		}
+	}
+
+	return fp.flush()
+}
+
+// predict writes the prediction of a size x size block at position (x, y) of the given reconstructed plane into dst.
+// The edge values outside of the image are the same as in the decoder.
+func predict(dst []uint8, mode int, plane []uint8, stride, x, y, size int) {
+	var above, left [16]int32
+	var corner int32
+	hasAbove, hasLeft := y > 0, x > 0
+
+	for i := 0; i < size; i++ {
+		above[i], left[i] = 127, 129
+		if hasAbove {
+			above[i] = int32(plane[(y-1)*stride+x+i])
+		}
+		if hasLeft {
+			left[i] = int32(plane[(y+i)*stride+x-1])
+		}
+	}
+	switch {
+	case !hasAbove:
+		corner = 127
+	case !hasLeft:
+		corner = 129
+	default:
+		corner = int32(plane[(y-1)*stride+x-1])
+	}
+
+	switch mode {
+	case vp8PredDC:
+		var sum, shift int32
+		if hasAbove {
+			for i := 0; i < size; i++ {
+				sum += above[i]
+			}
+			shift++
+		}
+		if hasLeft {
+			for i := 0; i < size; i++ {
+				sum += left[i]
+			}
+			shift++
+		}
+		dc := int32(128)
+		if shift > 0 {
+			if size == 16 {
+				shift += 3
+			} else {
+				shift += 2
+			}
+			dc = (sum + 1<<uint(shift-1)) >> uint(shift)
+		}
+		for i := 0; i < size*size; i++ {
+			dst[i] = uint8(dc)
+		}
+	case vp8PredV:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				dst[j*size+i] = uint8(above[i])
+			}
+		}
+	case vp8PredH:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				dst[j*size+i] = uint8(left[j])
+			}
+		}
+	case vp8PredTM:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				dst[j*size+i] = clip8(left[j] + above[i] - corner)
+			}
+		}
+	}
+}
+
+// sad returns the sum of absolute differences between a block of the plane and a prediction.
+func sad(pred []uint8, plane []uint8, stride, x, y, size int) int {
+	sum := 0
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			d := int(plane[(y+j)*stride+x+i]) - int(pred[j*size+i])
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+		}
+	}
+	return sum
+}
+
+// encodeMacroblock chooses the prediction modes, quantizes the residuals, writes the tokens and reconstructs the macroblock.
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	info := &e.mbInfo[mby*e.mbw+mbx]
+	x, y := mbx*16, mby*16
+	cx, cy := mbx*8, mby*8
+
+	// Choose the luma mode with the smallest difference
+	bestSAD := -1
+	for mode := vp8PredDC; mode <= vp8PredTM; mode++ {
+		predict(e.predBuf16[mode][:], mode, e.recY, e.yStride, x, y, 16)
+		if s := sad(e.predBuf16[mode][:], e.srcY, e.yStride, x, y, 16); bestSAD < 0 || s < bestSAD {
+			bestSAD, info.yMode = s, mode
+		}
+	}
+	predY := e.predBuf16[info.yMode][:]
+
+	// Choose the chroma mode with the smallest difference of both planes
+	bestSAD = -1
+	for mode := vp8PredDC; mode <= vp8PredTM; mode++ {
+		predict(e.predBuf16UV[mode][:64], mode, e.recU, e.cStride, cx, cy, 8)
+		predict(e.predBuf16UV[mode][64:128], mode, e.recV, e.cStride, cx, cy, 8)
+		s := sad(e.predBuf16UV[mode][:64], e.srcU, e.cStride, cx, cy, 8) + sad(e.predBuf16UV[mode][64:128], e.srcV, e.cStride, cx, cy, 8)
+		if bestSAD < 0 || s < bestSAD {
+			bestSAD, info.uvMode = s, mode
+		}
+	}
+	predU, predV := e.predBuf16UV[info.uvMode][:64], e.predBuf16UV[info.uvMode][64:128]
+
+	// Transform and quantize luma, the DC coefficients go into the Y2 block
+	var yCoeffs [16][16]int32 // Quantized coefficients of the luma blocks in raster order
+	var dcs [16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := (n%4)*4, (n/4)*4
+		var residual [16]int32
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				residual[j*4+i] = int32(e.srcY[(y+by+j)*e.yStride+x+bx+i]) - int32(predY[(by+j)*16+bx+i])
+			}
+		}
+		coeffs := fdct4(residual)
+		dcs[n] = coeffs[0]
+		for i := 1; i < 16; i++ {
+			yCoeffs[n][i] = quantize(coeffs[i], e.qY1[1], false)
+		}
+	}
+	var y2Coeffs [16]int32
+	for i, c := range fwht4(dcs) {
+		y2Coeffs[i] = quantize(c, e.qY2[btoi(i > 0)], i == 0)
+	}
+
+	// Transform and quantize chroma
+	var uvCoeffs [8][16]int32 // 4 blocks of U, followed by 4 blocks of V
+	for n := 0; n < 8; n++ {
+		src, pred := e.srcU, predU
+		if n >= 4 {
+			src, pred = e.srcV, predV
+		}
+		bx, by := (n%2)*4, ((n%4)/2)*4
+		var residual [16]int32
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				residual[j*4+i] = int32(src[(cy+by+j)*e.cStride+cx+bx+i]) - int32(pred[(by+j)*8+bx+i])
+			}
+		}
+		for i, c := range fdct4(residual) {
+			uvCoeffs[n][i] = quantize(c, e.qUV[btoi(i > 0)], i == 0)
+		}
+	}
+
+	// Check if there is anything to encode at all
+	info.skip = isZero(y2Coeffs[:])
+	for n := 0; n < 16 && info.skip; n++ {
+		info.skip = isZero(yCoeffs[n][:])
+	}
+	for n := 0; n < 8 && info.skip; n++ {
+		info.skip = isZero(uvCoeffs[n][:])
+	}
+
+	// Write tokens, or reset the contexts for skipped macroblocks
+	up, left := &e.upNonZero[mbx], &e.leftNonZero
+	if info.skip {
+		e.skipCount++
+		*up, *left = vp8NonZero{}, vp8NonZero{}
+	} else {
+		nz := e.writeTokens(y2Coeffs, vp8PlaneY2, up.y2+left.y2, 0)
+		up.y2, left.y2 = nz, nz
+		for n := 0; n < 16; n++ {
+			bx, by := n%4, n/4
+			nz := e.writeTokens(yCoeffs[n], vp8PlaneY1WithY2, up.y[bx]+left.y[by], 1)
+			up.y[bx], left.y[by] = nz, nz
+		}
+		for n := 0; n < 8; n++ {
+			upNZ, leftNZ := &up.u, &left.u
+			if n >= 4 {
+				upNZ, leftNZ = &up.v, &left.v
+			}
+			bx, by := n%2, (n%4)/2
+			nz := e.writeTokens(uvCoeffs[n], vp8PlaneUV, upNZ[bx]+leftNZ[by], 0)
+			upNZ[bx], leftNZ[by] = nz, nz
+		}
+	}
+
+	// Reconstruct the macroblock exactly like the decoder does
+	var y2Dequant [16]int32
+	for i, c := range y2Coeffs {
+		y2Dequant[i] = c * e.qY2[btoi(i > 0)]
+	}
+	dcs = iwht4(y2Dequant)
+	for n := 0; n < 16; n++ {
+		bx, by := (n%4)*4, (n/4)*4
+		var dequant [16]int32
+		dequant[0] = dcs[n]
+		for i := 1; i < 16; i++ {
+			dequant[i] = yCoeffs[n][i] * e.qY1[1]
+		}
+		residual := idct4(dequant)
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				e.recY[(y+by+j)*e.yStride+x+bx+i] = clip8(int32(predY[(by+j)*16+bx+i]) + residual[j*4+i])
+			}
+		}
+	}
+	for n := 0; n < 8; n++ {
+		rec, pred := e.recU, predU
+		if n >= 4 {
+			rec, pred = e.recV, predV
+		}
+		bx, by := (n%2)*4, ((n%4)/2)*4
+		var dequant [16]int32
+		for i, c := range uvCoeffs[n] {
+			dequant[i] = c * e.qUV[btoi(i > 0)]
+		}
+		residual := idct4(dequant)
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				rec[(cy+by+j)*e.cStride+cx+bx+i] = clip8(int32(pred[(by+j)*8+bx+i]) + residual[j*4+i])
+			}
+		}
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isZero(coeffs []int32) bool {
+	for _, c := range coeffs {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// quantize divides a coefficient by the quantization factor.
+// AC coefficients are rounded towards zero a bit more, which saves a lot of space for a small loss of detail.
+func quantize(c, q int32, dc bool) int32 {
+	sign := int32(1)
+	if c < 0 {
+		c, sign = -c, -1
+	}
+	bias := q / 2
+	if !dc {
+		bias = q * 3 / 8
+	}
+	v := (c + bias) / q
+	if v > 2048 {
+		v = 2048
+	}
+	return v * sign
+}
+
+// writeTokens writes the quantized coefficients of a 4x4 block, given in raster order, into the token partition.
+// It returns 1 if there was at least one non zero coefficient, 0 otherwise.
+func (e *vp8Encoder) writeTokens(coeffs [16]int32, plane int, context uint8, first int) uint8 {
+	t := e.tokens
+	probs := &vp8DefaultTokenProb[plane]
+
+	// Find the position of the last non zero coefficient in token order
+	last := -1
+	for n := first; n < 16; n++ {
+		if coeffs[vp8Zigzag[n]] != 0 {
+			last = n
+		}
+	}
+
+	n := first
+	p := &probs[vp8Bands[n]][context]
+	if last < 0 {
+		t.writeBool(false, p[0]) // End of block
+		return 0
+	}
+	t.writeBool(true, p[0])
+
+	for n < 16 {
+		v := coeffs[vp8Zigzag[n]]
+		n++
+
+		if v == 0 {
+			t.writeBool(false, p[1])
+			p = &probs[vp8Bands[n]][0] // There is no end of block token after a zero
+			continue
+		}
+		t.writeBool(true, p[1])
+
+		abs := v
+		if abs < 0 {
+			abs = -abs
+		}
+		switch {
+		case abs == 1:
+			t.writeBool(false, p[2])
+		case abs <= 4:
+			t.writeBool(true, p[2])
+			t.writeBool(false, p[3])
+			if abs == 2 {
+				t.writeBool(false, p[4])
+			} else {
+				t.writeBool(true, p[4])
+				t.writeBool(abs == 4, p[5])
+			}
+		case abs <= 10:
+			t.writeBool(true, p[2])
+			t.writeBool(true, p[3])
+			t.writeBool(false, p[6])
+			if abs <= 6 {
+				t.writeBool(false, p[7]) // Category 1
+				t.writeBool(abs == 6, 159)
+			} else {
+				t.writeBool(true, p[7]) // Category 2
+				t.writeBool((abs-7)&2 != 0, 165)
+				t.writeBool((abs-7)&1 != 0, 145)
+			}
+		default:
+			t.writeBool(true, p[2])
+			t.writeBool(true, p[3])
+			t.writeBool(true, p[6])
+			// Categories 3 to 6
+			cat := 3
+			for cat > 0 && abs < 3+(8<<uint(cat)) {
+				cat--
+			}
+			t.writeBool(cat >= 2, p[8])
+			t.writeBool(cat&1 != 0, p[9+cat/2])
+			extra := abs - (3 + (8 << uint(cat)))
+			catProbs := vp8CategoryProbs[cat]
+			for i, prob := range catProbs {
+				t.writeBool(extra&(1<<uint(len(catProbs)-1-i)) != 0, prob)
+			}
+		}
+		if abs == 1 {
+			p = &probs[vp8Bands[n]][1]
+		} else {
+			p = &probs[vp8Bands[n]][2]
+		}
+
+		t.writeBool(v < 0, 128) // Sign
+
+		if n == 16 {
+			break
+		}
+		if n > last {
+			t.writeBool(false, p[0]) // End of block
+			break
+		}
+		t.writeBool(true, p[0])
+	}
+
+	return 1
+}
+
+// fdct4 is the forward DCT of a 4x4 block, like it is used in libvpx.
+func fdct4(in [16]int32) (out [16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		ip := in[i*4 : i*4+4]
+		a1 := (ip[0] + ip[3]) * 8
+		b1 := (ip[1] + ip[2]) * 8
+		c1 := (ip[1] - ip[2]) * 8
+		d1 := (ip[0] - ip[3]) * 8
+		tmp[i*4+0] = a1 + b1
+		tmp[i*4+2] = a1 - b1
+		tmp[i*4+1] = (c1*2217 + d1*5352 + 14500) >> 12
+		tmp[i*4+3] = (d1*2217 - c1*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a1 := tmp[i] + tmp[12+i]
+		b1 := tmp[4+i] + tmp[8+i]
+		c1 := tmp[4+i] - tmp[8+i]
+		d1 := tmp[i] - tmp[12+i]
+		out[i] = (a1 + b1 + 7) >> 4
+		out[8+i] = (a1 - b1 + 7) >> 4
+		out[4+i] = (c1*2217+d1*5352+12000)>>16 + int32(btoi(d1 != 0))
+		out[12+i] = (d1*2217 - c1*5352 + 51000) >> 16
+	}
+	return
+}
+
+// idct4 is the inverse DCT of a 4x4 block, exactly like it is specified for the decoder.
+func idct4(in [16]int32) (out [16]int32) {
+	const c1, c2 = 85627, 35468 // 65536 * cos(pi/8) * sqrt(2) and 65536 * sin(pi/8) * sqrt(2)
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		a := in[i] + in[8+i]
+		b := in[i] - in[8+i]
+		c := (in[4+i]*c2)>>16 - (in[12+i]*c1)>>16
+		d := (in[4+i]*c1)>>16 + (in[12+i]*c2)>>16
+		tmp[i*4+0] = a + d
+		tmp[i*4+1] = b + c
+		tmp[i*4+2] = b - c
+		tmp[i*4+3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := tmp[j] + 4
+		a := dc + tmp[8+j]
+		b := dc - tmp[8+j]
+		c := (tmp[4+j]*c2)>>16 - (tmp[12+j]*c1)>>16
+		d := (tmp[4+j]*c1)>>16 + (tmp[12+j]*c2)>>16
+		out[j*4+0] = (a + d) >> 3
+		out[j*4+1] = (b + c) >> 3
+		out[j*4+2] = (b - c) >> 3
+		out[j*4+3] = (a - d) >> 3
+	}
+	return
+}
+
+// fwht4 is the forward Walsh-Hadamard transform of the luma DC coefficients, like it is used in libvpx.
+func fwht4(in [16]int32) (out [16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		ip := in[i*4 : i*4+4]
+		a1 := (ip[0] + ip[2]) * 4
+		d1 := (ip[1] + ip[3]) * 4
+		c1 := (ip[1] - ip[3]) * 4
+		b1 := (ip[0] - ip[2]) * 4
+		tmp[i*4+0] = a1 + d1 + int32(btoi(a1 != 0))
+		tmp[i*4+1] = b1 + c1
+		tmp[i*4+2] = b1 - c1
+		tmp[i*4+3] = a1 - d1
+	}
+	for i := 0; i < 4; i++ {
+		a1 := tmp[i] + tmp[8+i]
+		d1 := tmp[4+i] + tmp[12+i]
+		c1 := tmp[4+i] - tmp[12+i]
+		b1 := tmp[i] - tmp[8+i]
+		a2, b2, c2, d2 := a1+d1, b1+c1, b1-c1, a1-d1
+		a2 += int32(btoi(a2 < 0))
+		b2 += int32(btoi(b2 < 0))
+		c2 += int32(btoi(c2 < 0))
+		d2 += int32(btoi(d2 < 0))
+		out[i] = (a2 + 3) >> 3
+		out[4+i] = (b2 + 3) >> 3
+		out[8+i] = (c2 + 3) >> 3
+		out[12+i] = (d2 + 3) >> 3
+	}
+	return
+}
+
+// iwht4 is the inverse Walsh-Hadamard transform, exactly like it is specified for the decoder.
+// The result contains the DC coefficients of the 16 luma blocks in raster order.
+func iwht4(in [16]int32) (out [16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[i] - in[12+i]
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[i*4] + 3
+		a0 := dc + m[i*4+3]
+		a1 := m[i*4+1] + m[i*4+2]
+		a2 := m[i*4+1] - m[i*4+2]
+		a3 := dc - m[i*4+3]
+		out[i*4+0] = (a0 + a1) >> 3
+		out[i*4+1] = (a3 + a2) >> 3
+		out[i*4+2] = (a0 - a1) >> 3
+		out[i*4+3] = (a3 - a2) >> 3
+	}
+	return
+}
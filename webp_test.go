@@ -0,0 +1,97 @@
+// Copyright (C) 2020 David Vogel
+//
+// This file is part of Galago.
+//
+// Galago is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+//
+// Galago is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Galago.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// planePSNR returns the peak signal-to-noise ratio of the first width x height values of two planes with the given strides.
+func planePSNR(a []uint8, aStride int, b []uint8, bStride int, width, height int) float64 {
+	var sum float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			d := float64(a[y*aStride+x]) - float64(b[y*bStride+x])
+			sum += d * d
+		}
+	}
+	return psnr(sum, width*height)
+}
+
+func TestWebPRoundTrip(t *testing.T) {
+	tests := []struct {
+		width, height int
+		quality       int
+		edges         bool // Add hard edges, which are a lot harder to encode than the smooth waves of the pattern
+		minPSNR       float64
+	}{
+		{256, 192, 75, false, 40},
+		{256, 192, 95, false, 45},
+		{203, 141, 75, false, 40},
+		{17, 9, 50, false, 35},
+		{256, 192, 75, true, 30},
+		{256, 192, 95, true, 40},
+	}
+
+	for _, test := range tests {
+		img := testPatternImage(test.width, test.height)
+		if test.edges {
+			for y := 0; y < test.height; y++ {
+				for x := 0; x < test.width; x++ {
+					if (x/5+y/7)%2 == 0 {
+						i := img.PixOffset(x, y)
+						img.Pix[i], img.Pix[i+1], img.Pix[i+2] = 255-img.Pix[i], 255-img.Pix[i+1], img.Pix[i+2]/4
+					}
+				}
+			}
+		}
+
+		buf := new(bytes.Buffer)
+		if err := EncodeWebP(buf, img, &WebPOptions{Quality: test.quality}); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := webp.Decode(buf)
+		if err != nil {
+			t.Errorf("%dx%d with quality %d: Couldn't decode encoded image: %v", test.width, test.height, test.quality, err)
+			continue
+		}
+		ycbcr, ok := decoded.(*image.YCbCr)
+		if !ok || ycbcr.Rect != img.Rect || ycbcr.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+			t.Errorf("%dx%d with quality %d: Got decoded image %T with bounds %v", test.width, test.height, test.quality, decoded, decoded.Bounds())
+			continue
+		}
+
+		// Compare with the planes that the encoder got as input
+		e := newVP8Encoder(img, 0)
+		cw, ch := (test.width+1)/2, (test.height+1)/2
+		planes := map[string]float64{
+			"Y":  planePSNR(ycbcr.Y, ycbcr.YStride, e.srcY, e.yStride, test.width, test.height),
+			"Cb": planePSNR(ycbcr.Cb, ycbcr.CStride, e.srcU, e.cStride, cw, ch),
+			"Cr": planePSNR(ycbcr.Cr, ycbcr.CStride, e.srcV, e.cStride, cw, ch),
+		}
+		for plane, p := range planes {
+			if p < test.minPSNR {
+				t.Errorf("%dx%d with quality %d: PSNR of %s plane is %.1f dB, want at least %v dB", test.width, test.height, test.quality, plane, p, test.minPSNR)
+			}
+		}
+	}
+}